@@ -0,0 +1,120 @@
+// Accrual-mock is an in-memory accrual system for development and tests of gophermart.
+//
+// Orders and reward rules are registered by POST /api/orders and POST /api/goods
+// like in the real accrual system, or taken from -rules file:
+//
+//	{
+//	    "rules": [{"match": "Bork", "reward": 10, "reward_type": "%"}],
+//	    "goods": [{"description": "Чайник Bork", "price": 7000}]
+//	}
+//
+// With -auto unknown orders are registered on first poll with goods from the file.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"aprokhorov-diploma-1/internal/accrualmock"
+	"aprokhorov-diploma-1/internal/logger"
+
+	"github.com/caarlos0/env"
+)
+
+const parent string = "main"
+
+type Config struct {
+	Server       string        `env:"RUN_ADDRESS"`
+	Steps        int           `env:"ACCRUAL_MOCK_STEPS"`
+	Quota        int           `env:"ACCRUAL_MOCK_QUOTA"`
+	Latency      time.Duration `env:"ACCRUAL_MOCK_LATENCY"`
+	AutoRegister bool          `env:"ACCRUAL_MOCK_AUTO_REGISTER"`
+	RulesFile    string        `env:"ACCRUAL_MOCK_RULES"`
+	LogLevel     string        `env:"ACCRUAL_MOCK_LOGLEVEL"`
+}
+
+// Rules file content
+type rulesFile struct {
+	Rules []accrualmock.Rule `json:"rules"`
+	Goods []accrualmock.Good `json:"goods"`
+}
+
+func main() {
+	// Init Config: defaults < env < flags
+	config := Config{
+		Server:       "127.0.0.1:8081",
+		Steps:        1,
+		AutoRegister: true,
+		LogLevel:     "debug",
+	}
+	if err := env.Parse(&config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	flag.StringVar(&config.Server, "a", config.Server, "Server ip:port, env RUN_ADDRESS")
+	flag.IntVar(&config.Steps, "s", config.Steps, "Polls answered with every of REGISTERED and PROCESSING statuses, env ACCRUAL_MOCK_STEPS")
+	flag.IntVar(&config.Quota, "q", config.Quota, "Requests per minute allowed, 0 is unlimited, env ACCRUAL_MOCK_QUOTA")
+	flag.DurationVar(&config.Latency, "lt", config.Latency, "Latency of every respond, env ACCRUAL_MOCK_LATENCY")
+	flag.BoolVar(&config.AutoRegister, "auto", config.AutoRegister, "Register unknown orders on first poll instead of 204, env ACCRUAL_MOCK_AUTO_REGISTER")
+	flag.StringVar(&config.RulesFile, "rules", config.RulesFile, "JSON file with reward rules and goods of auto registered orders, env ACCRUAL_MOCK_RULES")
+	flag.StringVar(&config.LogLevel, "l", config.LogLevel, "Log Level, env ACCRUAL_MOCK_LOGLEVEL")
+	flag.Parse()
+
+	//Init Logger
+	log, err := logger.NewZeroLogger(config.LogLevel)
+	if err != nil {
+		panic(err)
+	}
+	log.Info(parent, fmt.Sprintf("%+v", config))
+
+	options := accrualmock.Options{
+		Steps:        config.Steps,
+		Quota:        config.Quota,
+		Latency:      config.Latency,
+		AutoRegister: config.AutoRegister,
+	}
+	if config.RulesFile != "" {
+		data, err := os.ReadFile(config.RulesFile)
+		if err != nil {
+			log.Fatal(parent, err.Error())
+		}
+		var rules rulesFile
+		if err := json.Unmarshal(data, &rules); err != nil {
+			log.Fatal(parent, fmt.Sprintf("rules file %s: %v", config.RulesFile, err))
+		}
+		options.Rules = rules.Rules
+		options.DefaultGoods = rules.Goods
+	}
+
+	mock, err := accrualmock.New(options, log)
+	if err != nil {
+		log.Fatal(parent, err.Error())
+	}
+
+	server := &http.Server{Addr: config.Server, Handler: mock}
+	go func() {
+		log.Info(parent, "Accrual mock listens on "+config.Server)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(parent, err.Error())
+		}
+	}()
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGTERM)
+	<-done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error(parent, err.Error())
+	}
+	log.Info(parent, "Accrual mock stopped")
+}
@@ -2,57 +2,121 @@ package accrual
 
 import (
 	"aprokhorov-diploma-1/internal/logger"
+	"aprokhorov-diploma-1/internal/money"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-resty/resty/v2"
 )
 
+// Retry delay used when accrual service answers 429 without valid Retry-After header
+const defaultRetryAfter = 60 * time.Second
+
+// ErrOrderNotRegistered is returned by FetchData when accrual service answers 204 No Content,
+// so order is unknown to accrual service yet
+var ErrOrderNotRegistered = errors.New("order is not registered in accrual service yet")
+
+// Statuses of accrual calculation answered by accrual service
+const (
+	StatusRegistered = "REGISTERED"
+	StatusProcessing = "PROCESSING"
+	StatusInvalid    = "INVALID"
+	StatusProcessed  = "PROCESSED"
+)
+
 type Order struct {
-	OrderID string  `json:"order"`
-	Status  string  `json:"status"`
-	Accrual float64 `json:"accrual"`
+	OrderID string      `json:"order"`
+	Status  string      `json:"status"`
+	Accrual money.Money `json:"accrual"`
 }
 
 func (o Order) String() string {
 	return fmt.Sprintf("OrderID:%s, Status:%s, Accrual: %v", o.OrderID, o.Status, o.Accrual)
 }
 
+// RateLimitError is returned by FetchData when accrual service answers 429 Too Many Requests.
+// RetryAfter is a delay before next request is allowed, RequestsPerMinute is a quota
+// advertised by service in respond body (0 if it can't be parsed).
+type RateLimitError struct {
+	RetryAfter        time.Duration
+	RequestsPerMinute int
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("accrual service rate limit exceeded, retry after:%v, quota:%d requests per minute", e.RetryAfter, e.RequestsPerMinute)
+}
+
+// Observer gets status code (0 if request failed) and duration of every request to accrual service
+type Observer interface {
+	ObserveAccrual(code int, duration time.Duration)
+}
+
 type AccrualService struct {
 	URL      string
-	Request  *resty.Request
+	Client   *resty.Client
 	Interval time.Duration
+	// Observer is optional
+	Observer Observer
 	log      logger.Logger
 }
 
-// `NewAccrualService` is a function that takes a URL and an interval and returns a pointer to an
+// `NewAccrualService` is a function that takes a URL, an interval and an app logger and returns a pointer to an
 // AccrualService struct
-func NewAccrualService(url string, ival time.Duration) *AccrualService {
-	request := resty.New().SetHeader("Context-Type", "application/json").R()
-	log, _ := logger.NewZeroLogger("debug")
+func NewAccrualService(url string, ival time.Duration, log logger.Logger) *AccrualService {
+	client := resty.New().SetHeader("Context-Type", "application/json")
 	return &AccrualService{
 		URL:      url,
-		Request:  request,
+		Client:   client,
 		Interval: ival,
 		log:      log,
 	}
 }
 
 // A function that is used to fetch data from the server.
-func (a *AccrualService) FetchData(orderNo string) (Order, error) {
+// Safe for concurrent use, every call builds its own request.
+// Logger and request id carried by ctx are used for logging and passed to accrual service.
+func (a *AccrualService) FetchData(ctx context.Context, orderNo string) (Order, error) {
 	order := Order{}
+	log := logger.FromContext(ctx, a.log)
 
 	// build url for request
 	url := fmt.Sprintf("/api/orders/%s", orderNo)
-	a.log.Debug("AccrualSerice", "http://"+a.URL+url)
+	log.Debug("AccrualSerice", "http://"+a.URL+url)
 	// Request himself
-	respond, err := a.Request.Get(a.URL + url)
+	request := a.Client.R().SetContext(ctx)
+	if id := logger.RequestID(ctx); id != "" {
+		request.SetHeader("X-Request-Id", id)
+	}
+	start := time.Now()
+	respond, err := request.Get(a.URL + url)
+	if a.Observer != nil {
+		code := 0
+		if err == nil {
+			code = respond.StatusCode()
+		}
+		a.Observer.ObserveAccrual(code, time.Since(start))
+	}
 	if err != nil {
 		return Order{}, err
 	}
 
+	if respond.StatusCode() == http.StatusNoContent {
+		return Order{}, ErrOrderNotRegistered
+	}
+
+	if respond.StatusCode() == http.StatusTooManyRequests {
+		return Order{}, &RateLimitError{
+			RetryAfter:        parseRetryAfter(respond.Header().Get("Retry-After")),
+			RequestsPerMinute: parseQuota(string(respond.Body())),
+		}
+	}
+
 	if respond.StatusCode() != http.StatusOK {
 		return Order{}, fmt.Errorf("respond status not success, status:%d body:%s", respond.StatusCode(), string(respond.Body()))
 	}
@@ -64,3 +128,34 @@ func (a *AccrualService) FetchData(orderNo string) (Order, error) {
 
 	return order, nil
 }
+
+// Ping checks accrual service is reachable, any HTTP response is fine
+func (a *AccrualService) Ping(ctx context.Context) error {
+	_, err := a.Client.R().SetContext(ctx).Get(a.URL)
+	return err
+}
+
+// parseRetryAfter converts Retry-After header value (delay in seconds or HTTP-date) to duration
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
+
+// parseQuota gets N from "No more than N requests per minute allowed" respond body
+func parseQuota(body string) int {
+	var quota int
+	_, err := fmt.Sscanf(strings.TrimSpace(body), "No more than %d requests per minute allowed", &quota)
+	if err != nil || quota < 0 {
+		return 0
+	}
+	return quota
+}
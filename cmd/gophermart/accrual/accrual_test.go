@@ -1,37 +1,133 @@
 package accrual
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"aprokhorov-diploma-1/internal/accrualmock"
+	"aprokhorov-diploma-1/internal/logger"
+	"aprokhorov-diploma-1/internal/money"
+
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestAccrualService_FetchData(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+	mock, err := accrualmock.New(accrualmock.Options{
+		Steps: 1,
+		Rules: []accrualmock.Rule{{Match: "Bork", Reward: 10, RewardType: accrualmock.RewardPercent}},
+	}, log)
+	require.NoError(t, err)
+	require.NoError(t, mock.RegisterOrder("371449635398431", accrualmock.Good{Description: "Пылесос LG", Price: 500000}))
+	require.NoError(t, mock.RegisterOrder("12345678903", accrualmock.Good{Description: "Чайник Bork", Price: 729980}))
+	require.NoError(t, mock.RegisterOrder("79927398713"))
+
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
 	tests := []struct {
 		name    string
 		orderNo string
-		want    Order
-		wantErr bool
+		want    []Order // answers of consecutive polls
 	}{
 		{
-			name:    "Live AccrualService Test",
+			name:    "Processed without accrual",
 			orderNo: "371449635398431",
-			want:    Order{OrderID: "371449635398431", Status: "PROCESSED", Accrual: 0},
-			wantErr: false,
+			want: []Order{
+				{OrderID: "371449635398431", Status: "REGISTERED"},
+				{OrderID: "371449635398431", Status: "PROCESSING"},
+				{OrderID: "371449635398431", Status: "PROCESSED", Accrual: 0},
+			},
+		},
+		{
+			name:    "Processed with accrual",
+			orderNo: "12345678903",
+			want: []Order{
+				{OrderID: "12345678903", Status: "REGISTERED"},
+				{OrderID: "12345678903", Status: "PROCESSING"},
+				{OrderID: "12345678903", Status: "PROCESSED", Accrual: money.FromFloat(729.98)},
+			},
+		},
+		{
+			name:    "Invalid",
+			orderNo: "79927398713",
+			want: []Order{
+				{OrderID: "79927398713", Status: "REGISTERED"},
+				{OrderID: "79927398713", Status: "PROCESSING"},
+				{OrderID: "79927398713", Status: "INVALID"},
+			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-
-			a := NewAccrualService("http://localhost:8081", time.Second)
-			order, err := a.FetchData(tt.orderNo)
-
-			if !tt.wantErr {
+			a := NewAccrualService(server.URL, time.Second, log)
+			for _, want := range tt.want {
+				order, err := a.FetchData(context.Background(), tt.orderNo)
 				assert.NoError(t, err)
+				assert.EqualValues(t, want, order)
 			}
+		})
+	}
+}
 
-			assert.EqualValues(t, tt.want, order)
+func TestAccrualService_FetchData_TooManyRequests(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+	tests := []struct {
+		name       string
+		retryAfter string
+		body       string
+		want       RateLimitError
+	}{
+		{
+			name:       "Retry-After in seconds with quota",
+			retryAfter: "60",
+			body:       "No more than 10 requests per minute allowed",
+			want:       RateLimitError{RetryAfter: 60 * time.Second, RequestsPerMinute: 10},
+		},
+		{
+			name:       "Missed Retry-After and unknown body",
+			retryAfter: "",
+			body:       "slow down",
+			want:       RateLimitError{RetryAfter: defaultRetryAfter, RequestsPerMinute: 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(http.StatusTooManyRequests)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			a := NewAccrualService(server.URL, time.Second, log)
+			order, err := a.FetchData(context.Background(), "371449635398431")
+
+			var rateErr *RateLimitError
+			assert.ErrorAs(t, err, &rateErr)
+			assert.EqualValues(t, tt.want, *rateErr)
+			assert.EqualValues(t, Order{}, order)
 		})
 	}
 }
+
+func TestAccrualService_FetchData_NoContent(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	a := NewAccrualService(server.URL, time.Second, log)
+	order, err := a.FetchData(context.Background(), "371449635398431")
+
+	assert.ErrorIs(t, err, ErrOrderNotRegistered)
+	assert.EqualValues(t, Order{}, order)
+}
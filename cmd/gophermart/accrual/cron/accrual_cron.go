@@ -2,53 +2,205 @@ package cron
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"aprokhorov-diploma-1/cmd/gophermart/accrual"
+	"aprokhorov-diploma-1/internal/lifecycle"
 	"aprokhorov-diploma-1/internal/logger"
 	"aprokhorov-diploma-1/internal/storage"
 )
 
-func StartOrderCheckProcess(ctx context.Context, signal <-chan time.Time, accrual *accrual.AccrualService, database storage.Storage, log logger.Logger) {
-	parent := "Accrual:CheckTask"
+const parent = "Accrual:CheckTask"
+
+// Limit of fetching and saving order taken by worker, it is interrupted by shutdown only when shutdown times out
+const orderTimeout = 30 * time.Second
+
+// Observer gets duration of every tick and number of undone orders found on it
+type Observer interface {
+	ObserveTick(duration time.Duration, backlog int)
+}
+
+// Heartbeat is told cron is alive on every tick, including ticks coming while previous one
+// still hands orders to workers busy with big backlog or paused by rate limit
+type Heartbeat interface {
+	Beat()
+}
+
+// checker holds everything workers share while processing orders
+type checker struct {
+	accrualService  *accrual.AccrualService
+	database        storage.Storage
+	limiter         *limiter
+	registerTimeout time.Duration
+	log             logger.Logger
+}
+
+// StartOrderCheckProcess polls accrual service for undone orders on every signal.
+// Orders are fetched concurrently by pool of workers sharing one rate limiter.
+// Orders unknown to accrual service for longer than registerTimeout are marked INVALID.
+// Tick lasts until all undone orders are handed to workers, observer is optional
+// and gets only ticks which fetched undone orders successfully, so does optional heartbeat.
+// Returns when ctx is cancelled and workers have finished orders they took.
+func StartOrderCheckProcess(ctx context.Context, signal <-chan time.Time, accrualService *accrual.AccrualService, workers int, registerTimeout time.Duration, database storage.Storage, observer Observer, heartbeat Heartbeat, log logger.Logger) {
+	c := &checker{
+		accrualService:  accrualService,
+		database:        database,
+		limiter:         newLimiter(),
+		registerTimeout: registerTimeout,
+		log:             log,
+	}
+	processing := newInflight()
+	beat := func() {
+		if heartbeat != nil {
+			heartbeat.Beat()
+		}
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	// Start workers
+	jobs := make(chan *storage.Order)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for order := range jobs {
+				c.checkOrder(ctx, order)
+				processing.Release(order.OrderID)
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
 
 	for {
 		select {
 		case <-signal:
 			//log.Debug(parent, "Update Orders from Accrual Service")
+			start := time.Now()
 			orders, err := database.GetOrdersUndone(ctx)
 			if err != nil {
 				log.Error(parent, err.Error())
+				continue
 			}
+			beat()
 
 			for _, order := range orders {
-				orderAccrual, err := accrual.FetchData(order.OrderID)
-				if err != nil {
-					log.Info(parent, err.Error())
+				// Skip orders still processing since previous tick
+				if !processing.Acquire(order.OrderID) {
+					continue
 				}
-
-				if orderAccrual.OrderID != "" {
-					log.Debug(parent, fmt.Sprint(orderAccrual))
-					err = database.ModifyOrder(ctx, orderAccrual.OrderID, orderAccrual.Status, orderAccrual.Accrual)
-					if err != nil {
-						log.Info(parent, err.Error())
-					}
-
-					balance, err := database.GetBalance(ctx, order.Login)
-					if err != nil {
-						log.Info(parent, err.Error())
-					}
-
-					newBalance := balance.CurrentScore + orderAccrual.Accrual
-					err = database.ModifyBalance(ctx, order.Login, newBalance, balance.TotalWithdrawals)
-					if err != nil {
-						log.Info(parent, err.Error())
+			handOver:
+				for {
+					select {
+					case jobs <- order:
+						break handOver
+					case <-signal:
+						// Workers are behind, tick is skipped, but cron is alive
+						beat()
+					case <-ctx.Done():
+						processing.Release(order.OrderID)
+						return
 					}
 				}
 			}
+			if observer != nil {
+				observer.ObserveTick(time.Since(start), len(orders))
+			}
 		case <-ctx.Done():
 			return
 		}
 	}
 }
+
+// checkOrder fetches order from accrual service and saves result
+func (c *checker) checkOrder(ctx context.Context, order *storage.Order) {
+	// Every line about this check carries order number
+	log := c.log.With("order", order.OrderID)
+	ctx = logger.NewContext(ctx, log)
+
+	if err := c.limiter.Wait(ctx); err != nil {
+		return
+	}
+
+	// Order taken is finished on shutdown, so fetched accrual is not lost
+	ctx, cancel := context.WithTimeout(lifecycle.Detach(ctx), orderTimeout)
+	defer cancel()
+
+	orderAccrual, err := c.accrualService.FetchData(ctx, order.OrderID)
+	if errors.Is(err, accrual.ErrOrderNotRegistered) {
+		c.checkUnregistered(ctx, order)
+		return
+	}
+	if err != nil {
+		var rateErr *accrual.RateLimitError
+		if errors.As(err, &rateErr) {
+			// Hold back all workers, order will be fetched again on next tick
+			log.Warning(parent, err.Error())
+			c.limiter.Pause(time.Now().Add(rateErr.RetryAfter), rateErr.RequestsPerMinute)
+			return
+		}
+		log.Info(parent, err.Error())
+		return
+	}
+
+	if orderAccrual.OrderID != "" {
+		log.Debug(parent, fmt.Sprint(orderAccrual))
+		status, ok := orderStatus(orderAccrual.Status)
+		if !ok {
+			log.Warning(parent, fmt.Sprintf("Unknown accrual status %q, order is kept %s", orderAccrual.Status, order.Status))
+			return
+		}
+		// Registered order stays NEW, there is nothing to save yet
+		if status == storage.StatusNew {
+			return
+		}
+		err = c.database.ApplyAccrual(ctx, orderAccrual.OrderID, status, orderAccrual.Accrual)
+		if err != nil {
+			log.Error(parent, err.Error())
+		}
+	}
+}
+
+// orderStatus maps accrual service status to order status of user API
+func orderStatus(accrualStatus string) (string, bool) {
+	switch accrualStatus {
+	case accrual.StatusRegistered:
+		return storage.StatusNew, true
+	case accrual.StatusProcessing:
+		return storage.StatusProcessing, true
+	case accrual.StatusInvalid:
+		return storage.StatusInvalid, true
+	case accrual.StatusProcessed:
+		return storage.StatusProcessed, true
+	}
+	return "", false
+}
+
+// checkUnregistered counts attempts to fetch order unknown to accrual service
+// and gives up on it when order was uploaded more than registerTimeout ago
+func (c *checker) checkUnregistered(ctx context.Context, order *storage.Order) {
+	log := logger.FromContext(ctx, c.log)
+	if time.Since(time.Time(order.UploadedAt)) > c.registerTimeout {
+		log.Info(parent, fmt.Sprintf("Order %s not registered in AccrualService after %d attempts, mark INVALID", order.OrderID, order.Attempts+1))
+		err := c.database.ApplyAccrual(ctx, order.OrderID, storage.StatusInvalid, 0)
+		if err != nil {
+			log.Error(parent, err.Error())
+		}
+		return
+	}
+
+	log.Debug(parent, fmt.Sprintf("Order %s not registered in AccrualService yet, attempt %d", order.OrderID, order.Attempts+1))
+	err := c.database.AddOrderAttempt(ctx, order.OrderID)
+	if err != nil {
+		log.Error(parent, err.Error())
+	}
+}
@@ -0,0 +1,179 @@
+package cron
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aprokhorov-diploma-1/cmd/gophermart/accrual"
+	"aprokhorov-diploma-1/internal/accrualmock"
+	"aprokhorov-diploma-1/internal/logger"
+	"aprokhorov-diploma-1/internal/money"
+	"aprokhorov-diploma-1/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecker_CheckOrder(t *testing.T) {
+	ctx := context.Background()
+	log, _ := logger.NewZeroLogger("error")
+
+	mock, err := accrualmock.New(accrualmock.Options{
+		Steps: 1,
+		Rules: []accrualmock.Rule{{Match: "Bork", Reward: 10, RewardType: accrualmock.RewardPercent}},
+	}, log)
+	require.NoError(t, err)
+	require.NoError(t, mock.RegisterOrder("12345678903", accrualmock.Good{Description: "Чайник Bork", Price: 700000}))
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	database := storage.NewMemory()
+	require.NoError(t, database.RegisterUser(ctx, "user", "hash", ""))
+	require.NoError(t, database.AddBalance(ctx, "user", 0, 0))
+	require.NoError(t, database.AddOrder(ctx, "user", "12345678903"))
+	require.NoError(t, database.AddOrder(ctx, "user", "79927398713"))
+
+	c := &checker{
+		accrualService:  accrual.NewAccrualService(server.URL, time.Second, log),
+		database:        database,
+		limiter:         newLimiter(),
+		registerTimeout: time.Hour,
+		log:             log,
+	}
+
+	tests := []struct {
+		name        string
+		orderNo     string
+		wantStatus  string
+		wantAccrual money.Money
+	}{
+		{name: "REGISTERED is kept NEW", orderNo: "12345678903", wantStatus: storage.StatusNew},
+		{name: "PROCESSING", orderNo: "12345678903", wantStatus: storage.StatusProcessing},
+		{name: "PROCESSED", orderNo: "12345678903", wantStatus: storage.StatusProcessed, wantAccrual: money.FromFloat(700)},
+		{name: "Unknown to accrual service is kept NEW", orderNo: "79927398713", wantStatus: storage.StatusNew},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, err := database.GetOrder(ctx, tt.orderNo)
+			require.NoError(t, err)
+
+			c.checkOrder(ctx, &order)
+
+			order, err = database.GetOrder(ctx, tt.orderNo)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, order.Status)
+			assert.Equal(t, tt.wantAccrual, order.Score)
+		})
+	}
+}
+
+type testHeartbeat struct {
+	beats int32
+}
+
+func (h *testHeartbeat) Beat() {
+	atomic.AddInt32(&h.beats, 1)
+}
+
+func TestStartOrderCheckProcess_Heartbeat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	log, _ := logger.NewZeroLogger("error")
+
+	// Accrual service hangs, so the only worker is busy and tick can't hand other orders over
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	database := storage.NewMemory()
+	for _, orderNo := range []string{"12345678903", "79927398713", "2377225624"} {
+		require.NoError(t, database.AddOrder(ctx, "user", orderNo))
+	}
+
+	signal := make(chan time.Time)
+	heartbeat := &testHeartbeat{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		StartOrderCheckProcess(ctx, signal, accrual.NewAccrualService(server.URL, time.Second, log), 1, time.Hour, database, nil, heartbeat, log)
+	}()
+
+	signal <- time.Now()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&heartbeat.beats) == 1 }, time.Second, time.Millisecond)
+
+	// Ticks coming during long tick still beat
+	signal <- time.Now()
+	signal <- time.Now()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&heartbeat.beats) == 3 }, time.Second, time.Millisecond)
+
+	close(release)
+	cancel()
+	<-done
+}
+
+func TestStartOrderCheckProcess_OrderFetchedOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	log, _ := logger.NewZeroLogger("error")
+	orders := []string{"12345678903", "79927398713", "2377225624"}
+
+	// Slow accrual service counts concurrent fetches of every order
+	var (
+		mutex   sync.Mutex
+		active  = make(map[string]int)
+		maxSeen = make(map[string]int)
+		fetches int32
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		orderNo := path.Base(r.URL.Path)
+		mutex.Lock()
+		active[orderNo]++
+		if active[orderNo] > maxSeen[orderNo] {
+			maxSeen[orderNo] = active[orderNo]
+		}
+		mutex.Unlock()
+		atomic.AddInt32(&fetches, 1)
+
+		time.Sleep(20 * time.Millisecond)
+
+		mutex.Lock()
+		active[orderNo]--
+		mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	database := storage.NewMemory()
+	for _, orderNo := range orders {
+		require.NoError(t, database.AddOrder(ctx, "user", orderNo))
+	}
+
+	signal := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		StartOrderCheckProcess(ctx, signal, accrual.NewAccrualService(server.URL, time.Second, log), 4, time.Hour, database, nil, nil, log)
+	}()
+
+	// Ticks come faster than orders are fetched
+	for i := 0; i < 30; i++ {
+		signal <- time.Now()
+		time.Sleep(3 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	assert.Greater(t, atomic.LoadInt32(&fetches), int32(len(orders)), "orders are fetched again after previous fetch")
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, orderNo := range orders {
+		assert.Equal(t, 1, maxSeen[orderNo], "order %s is fetched by one worker at a time", orderNo)
+	}
+}
@@ -0,0 +1,34 @@
+package cron
+
+import "sync"
+
+// inflight keeps orders being processed by workers right now,
+// so the same order is never fetched by two workers at once
+type inflight struct {
+	mutex  *sync.Mutex
+	orders map[string]struct{}
+}
+
+func newInflight() *inflight {
+	return &inflight{
+		mutex:  &sync.Mutex{},
+		orders: make(map[string]struct{}),
+	}
+}
+
+// Acquire marks order as processing, returns false if order is processing already
+func (i *inflight) Acquire(order string) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if _, exist := i.orders[order]; exist {
+		return false
+	}
+	i.orders[order] = struct{}{}
+	return true
+}
+
+func (i *inflight) Release(order string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	delete(i.orders, order)
+}
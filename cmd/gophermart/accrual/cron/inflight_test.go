@@ -0,0 +1,22 @@
+package cron
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInflight(t *testing.T) {
+	processing := newInflight()
+
+	assert.True(t, processing.Acquire("12345678903"))
+	assert.False(t, processing.Acquire("12345678903"), "order is processing already")
+	assert.True(t, processing.Acquire("79927398713"), "other order is free")
+
+	processing.Release("12345678903")
+	assert.True(t, processing.Acquire("12345678903"), "released order is free again")
+
+	// Release of free order changes nothing
+	processing.Release("2377225624")
+	assert.False(t, processing.Acquire("79927398713"))
+}
@@ -0,0 +1,67 @@
+package cron
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiter holds back requests to accrual service: pause till deadline after 429 respond
+// and spread requests evenly according to advertised quota
+type limiter struct {
+	mutex       *sync.Mutex
+	pausedUntil time.Time
+	interval    time.Duration
+	next        time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Wait blocks till next request to accrual service is allowed or context is done
+func (l *limiter) Wait(ctx context.Context) error {
+	now := time.Now()
+	delay := l.reserve(now).Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes slot for next request and returns time request is allowed at
+func (l *limiter) reserve(now time.Time) time.Time {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	at := now
+	if l.pausedUntil.After(at) {
+		at = l.pausedUntil
+	}
+	if l.next.After(at) {
+		at = l.next
+	}
+	l.next = at.Add(l.interval)
+	return at
+}
+
+// Pause stops all requests till deadline and throttles next ones to perMinute quota
+func (l *limiter) Pause(until time.Time, perMinute int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	if perMinute > 0 {
+		l.interval = time.Minute / time.Duration(perMinute)
+	}
+}
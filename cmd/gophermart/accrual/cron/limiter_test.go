@@ -0,0 +1,90 @@
+package cron
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter_Reserve(t *testing.T) {
+	start := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	type pause struct {
+		until     time.Duration // since start
+		perMinute int
+	}
+	tests := []struct {
+		name     string
+		pauses   []pause
+		requests []time.Duration // made at, since start
+		want     []time.Duration // allowed at, since start
+	}{
+		{
+			name:     "No limits",
+			requests: []time.Duration{0, 0, time.Second},
+			want:     []time.Duration{0, 0, time.Second},
+		},
+		{
+			name:     "Pause holds back every worker till deadline",
+			pauses:   []pause{{until: 10 * time.Second}},
+			requests: []time.Duration{0, time.Second, 11 * time.Second},
+			want:     []time.Duration{10 * time.Second, 10 * time.Second, 11 * time.Second},
+		},
+		{
+			name:     "Quota spreads requests",
+			pauses:   []pause{{until: 0, perMinute: 60}},
+			requests: []time.Duration{0, 0, 0, 10 * time.Second},
+			want:     []time.Duration{0, time.Second, 2 * time.Second, 10 * time.Second},
+		},
+		{
+			name:     "Quota applies after pause",
+			pauses:   []pause{{until: 10 * time.Second, perMinute: 30}},
+			requests: []time.Duration{0, 0},
+			want:     []time.Duration{10 * time.Second, 12 * time.Second},
+		},
+		{
+			name:     "Shorter pause doesn't cut longer one",
+			pauses:   []pause{{until: 10 * time.Second}, {until: 5 * time.Second}},
+			requests: []time.Duration{0},
+			want:     []time.Duration{10 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter()
+			for _, p := range tt.pauses {
+				l.Pause(start.Add(p.until), p.perMinute)
+			}
+			for i, at := range tt.requests {
+				assert.Equal(t, start.Add(tt.want[i]), l.reserve(start.Add(at)), "request %d", i)
+			}
+		})
+	}
+}
+
+func TestLimiter_Wait(t *testing.T) {
+	l := newLimiter()
+	deadline := time.Now().Add(50 * time.Millisecond)
+
+	// Pause by one worker holds back the others
+	l.Pause(deadline, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, l.Wait(context.Background()))
+			assert.False(t, time.Now().Before(deadline))
+		}()
+	}
+	wg.Wait()
+
+	// Waiting is interrupted by context
+	l.Pause(time.Now().Add(time.Hour), 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, l.Wait(ctx), context.DeadlineExceeded)
+}
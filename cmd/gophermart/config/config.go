@@ -2,47 +2,137 @@ package config
 
 import (
 	"fmt"
-
-	"github.com/caarlos0/env"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
 )
 
+// Config of gophermart. Every field is set from, in order of increasing precedence:
+// default, config file (yaml key), environment (env, or env with _FILE suffix holding
+// path to file with value for secret fields) and command line (flag).
 type Config struct {
-	Server                   string `env:"RUN_ADDRESS"`
-	Database                 string `env:"DATABASE_URI"`
-	AccrualService           string `env:"ACCRUAL_SYSTEM_ADDRESS"`
-	AccrualFrequency         string `env:"ACCRUAL_FREQUENCY"`
-	DBName                   string `env:"DATABASE_NAME"`
-	LogLevel                 string `env:"GOPHERMART_LOGLEVEL"`
-	AuthCacheTimeout         string `env:"AUTH_CACHE_TIMEOUT"`
-	AuthCacheHouseKeeperTime string `env:"AUTH_CACHE_HOUSEKEEPER_TIME"`
-}
-
-func (c *Config) EnvInit() error {
-	err := env.Parse(c)
+	Server                   string        `yaml:"run_address" env:"RUN_ADDRESS" flag:"a" usage:"Server ip:port"`
+	Database                 string        `yaml:"database_uri" env:"DATABASE_URI" flag:"d" secret:"true" usage:"Database URI, memory:// for in-memory storage"`
+	DBName                   string        `yaml:"database_name" env:"DATABASE_NAME" flag:"dn" usage:"Database Name"`
+	AccrualService           URL           `yaml:"accrual_system_address" env:"ACCRUAL_SYSTEM_ADDRESS" flag:"r" usage:"AccrualService URL"`
+	AccrualFrequency         time.Duration `yaml:"accrual_frequency" env:"ACCRUAL_FREQUENCY" flag:"rf" usage:"AccrualService polling interval"`
+	AccrualRegisterDays      int           `yaml:"accrual_register_days" env:"ACCRUAL_REGISTER_DAYS" flag:"rd" usage:"Days to wait order registration in AccrualService before mark it INVALID"`
+	AccrualWorkers           int           `yaml:"accrual_workers" env:"ACCRUAL_WORKERS" flag:"rw" usage:"AccrualService concurrent Workers"`
+	LogLevel                 string        `yaml:"log_level" env:"GOPHERMART_LOGLEVEL" flag:"l" usage:"Log Level: debug, info, warn, error"`
+	AuthCache                string        `yaml:"auth_cache" env:"AUTH_CACHE" flag:"ac" usage:"Auth Cache storage: memory, postgres or signed (stateless)"`
+	AuthCacheTimeout         time.Duration `yaml:"auth_cache_timeout" env:"AUTH_CACHE_TIMEOUT" flag:"at" usage:"Auth Cache Timeout"`
+	AuthCacheHouseKeeperTime time.Duration `yaml:"auth_cache_housekeeper_time" env:"AUTH_CACHE_HOUSEKEEPER_TIME" flag:"ah" usage:"Auth Cache HouseKeeper Interval"`
+	AuthSigningKey           string        `yaml:"auth_signing_key" env:"AUTH_SIGNING_KEY" flag:"ak" secret:"true" usage:"Auth Signing Key for signed Auth Cache, id:secret"`
+	AuthSigningPreviousKey   string        `yaml:"auth_signing_previous_key" env:"AUTH_SIGNING_PREVIOUS_KEY" flag:"akp" secret:"true" usage:"Previous Auth Signing Key accepted during grace period, id:secret"`
+	AuthSigningGrace         time.Duration `yaml:"auth_signing_grace" env:"AUTH_SIGNING_GRACE" flag:"akg" usage:"Previous Auth Signing Key grace period"`
+	AuthSessionMaxAge        time.Duration `yaml:"auth_session_max_age" env:"AUTH_SESSION_MAX_AGE" flag:"asm" usage:"Max age of signed Auth session, token is not reissued beyond it"`
+	LedgerReconcileTime      time.Duration `yaml:"ledger_reconcile_time" env:"LEDGER_RECONCILE_TIME" flag:"lr" usage:"Ledger Reconciliation Interval"`
+	PasswordHash             string        `yaml:"password_hash" env:"PASSWORD_HASH" flag:"ph" usage:"Password hashing algorithm: argon2id or bcrypt"`
+	LoginMaxFailures         int           `yaml:"login_max_failures" env:"LOGIN_MAX_FAILURES" flag:"lf" usage:"Failed logins per login before lockout"`
+	LoginMaxIPFailures       int           `yaml:"login_max_ip_failures" env:"LOGIN_MAX_IP_FAILURES" flag:"lfi" usage:"Failed logins per IP before lockout"`
+	LoginLockout             time.Duration `yaml:"login_lockout" env:"LOGIN_LOCKOUT" flag:"ll" usage:"First login lockout, doubled on every next failure"`
+	LoginMaxLockout          time.Duration `yaml:"login_max_lockout" env:"LOGIN_MAX_LOCKOUT" flag:"llm" usage:"Max login lockout"`
+	PasswordMinLength        int           `yaml:"password_min_length" env:"PASSWORD_MIN_LENGTH" flag:"pml" usage:"Min password length on registration"`
+	PasswordClasses          int           `yaml:"password_char_classes" env:"PASSWORD_CHAR_CLASSES" flag:"pcc" usage:"Min character classes (lower, upper, digits, other) in password"`
+	PasswordDenyList         string        `yaml:"password_denylist" env:"PASSWORD_DENYLIST" flag:"pdl" usage:"File with denied passwords, one per line, added to built-in list"`
+	AdminAddress             string        `yaml:"admin_address" env:"ADMIN_ADDRESS" flag:"aa" usage:"Admin Server ip:port for /metrics, empty to disable"`
+	ShutdownTimeout          time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"st" usage:"Graceful Shutdown Timeout"`
+	ShutdownDrainDelay       time.Duration `yaml:"shutdown_drain_delay" env:"SHUTDOWN_DRAIN_DELAY" flag:"sd" usage:"Delay between dropping readiness and stopping server on shutdown, part of Shutdown Timeout"`
+}
+
+// Default returns config used when nothing else is set
+func Default() *Config {
+	return &Config{
+		Server:                   "127.0.0.1:8080",
+		AccrualService:           MustParseURL("http://127.0.0.1:8081"),
+		AccrualFrequency:         50 * time.Microsecond,
+		AccrualRegisterDays:      7,
+		AccrualWorkers:           4,
+		LogLevel:                 "debug",
+		AuthCache:                "memory",
+		AuthCacheTimeout:         300 * time.Second,
+		AuthCacheHouseKeeperTime: time.Hour,
+		AuthSigningGrace:         24 * time.Hour,
+		AuthSessionMaxAge:        7 * 24 * time.Hour,
+		LedgerReconcileTime:      time.Hour,
+		PasswordHash:             "argon2id",
+		LoginMaxFailures:         5,
+		LoginMaxIPFailures:       20,
+		LoginLockout:             30 * time.Second,
+		LoginMaxLockout:          time.Hour,
+		PasswordMinLength:        8,
+		PasswordClasses:          2,
+		AdminAddress:             "127.0.0.1:9091",
+		ShutdownTimeout:          30 * time.Second,
+		ShutdownDrainDelay:       5 * time.Second,
+	}
+}
+
+// String prints every field, secrets are redacted
+func (c Config) String() string {
+	v := reflect.ValueOf(c)
+	fields := make([]string, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := formatValue(v.Field(i))
+		if field.Tag.Get("secret") == "true" {
+			value = redact(value)
+		}
+		fields = append(fields, fmt.Sprintf("%s: %s", field.Name, value))
+	}
+	return strings.Join(fields, ", ")
+}
+
+// Password in key=value DSN
+var dsnPassword = regexp.MustCompile(`password=\S+`)
+
+// redact hides password of URL or DSN, any other secret is hidden entirely
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	if u, err := url.Parse(value); err == nil && u.Scheme != "" && u.Opaque == "" {
+		if _, ok := u.User.Password(); !ok {
+			return value
+		}
+		return u.Redacted()
+	}
+	if dsnPassword.MatchString(value) {
+		return dsnPassword.ReplaceAllString(value, "password=xxxxx")
+	}
+	return "xxxxx"
+}
+
+// URL is absolute URL, parsed from text in config file, environment and flags
+type URL struct {
+	url.URL
+}
+
+// MustParseURL is for defaults, it panics on bad URL
+func MustParseURL(raw string) URL {
+	var u URL
+	if err := u.UnmarshalText([]byte(raw)); err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func (u *URL) UnmarshalText(text []byte) error {
+	parsed, err := url.Parse(string(text))
 	if err != nil {
 		return err
 	}
+	u.URL = *parsed
 	return nil
 }
 
-func (c Config) String() string {
-	return fmt.Sprintf(
-		"Server: %s, Database: %s, Database Name: %s, AccrualService: %s, LogLevel:%v, AuthCacheTimeout:%v, HouseKeeperDur:%v",
-		c.Server,
-		c.Database,
-		c.DBName,
-		c.AccrualService,
-		c.LogLevel,
-		c.AuthCacheTimeout,
-		c.AuthCacheHouseKeeperTime,
-	)
-}
-
-func NewServerConfig() *Config {
-	return &Config{
-		Server:         "",
-		Database:       "",
-		AccrualService: "",
-		LogLevel:       "",
-	}
+func (u URL) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+// String returns URL without trailing slash, so paths can be appended
+func (u URL) String() string {
+	return strings.TrimSuffix(u.URL.String(), "/")
 }
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func load(t *testing.T, args ...string) (*Config, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return Load(fs, args)
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	yamlFile := writeFile(t, "config.yaml", `
+run_address: 0.0.0.0:8000
+database_uri: postgres://file@db/gophermart
+accrual_frequency: 2s
+accrual_workers: 8
+auth_cache_timeout: 10m
+`)
+	jsonFile := writeFile(t, "config.json", `{"run_address": "0.0.0.0:8001", "accrual_workers": 2}`)
+
+	tests := []struct {
+		name        string
+		args        []string
+		env         map[string]string
+		wantServer  string
+		wantWorkers int
+		wantFreq    time.Duration
+		wantTimeout time.Duration
+	}{
+		{
+			name:        "Defaults",
+			wantServer:  "127.0.0.1:8080",
+			wantWorkers: 4,
+			wantFreq:    50 * time.Microsecond,
+			wantTimeout: 300 * time.Second,
+		},
+		{
+			name:        "File overrides defaults",
+			args:        []string{"-c", yamlFile},
+			wantServer:  "0.0.0.0:8000",
+			wantWorkers: 8,
+			wantFreq:    2 * time.Second,
+			wantTimeout: 10 * time.Minute,
+		},
+		{
+			name:        "JSON file from env",
+			env:         map[string]string{"GOPHERMART_CONFIG": jsonFile},
+			wantServer:  "0.0.0.0:8001",
+			wantWorkers: 2,
+			wantFreq:    50 * time.Microsecond,
+			wantTimeout: 300 * time.Second,
+		},
+		{
+			name:        "Env overrides file",
+			args:        []string{"-c", yamlFile},
+			env:         map[string]string{"RUN_ADDRESS": "0.0.0.0:9000", "ACCRUAL_FREQUENCY": "5s"},
+			wantServer:  "0.0.0.0:9000",
+			wantWorkers: 8,
+			wantFreq:    5 * time.Second,
+			wantTimeout: 10 * time.Minute,
+		},
+		{
+			name:        "Flags override env",
+			args:        []string{"-c", yamlFile, "-a", "0.0.0.0:9100", "-rw", "16"},
+			env:         map[string]string{"RUN_ADDRESS": "0.0.0.0:9000", "ACCRUAL_WORKERS": "12"},
+			wantServer:  "0.0.0.0:9100",
+			wantWorkers: 16,
+			wantFreq:    2 * time.Second,
+			wantTimeout: 10 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			c, err := load(t, tt.args...)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantServer, c.Server)
+			assert.Equal(t, tt.wantWorkers, c.AccrualWorkers)
+			assert.Equal(t, tt.wantFreq, c.AccrualFrequency)
+			assert.Equal(t, tt.wantTimeout, c.AuthCacheTimeout)
+		})
+	}
+}
+
+func TestLoad_SecretFile(t *testing.T) {
+	secret := writeFile(t, "database_uri", "postgres://app:s3cret@db/gophermart\n")
+
+	t.Setenv("DATABASE_URI_FILE", secret)
+	c, err := load(t)
+	require.NoError(t, err)
+	assert.Equal(t, "postgres://app:s3cret@db/gophermart", c.Database)
+
+	// Ambiguous source of secret
+	t.Setenv("DATABASE_URI", "postgres://app:other@db/gophermart")
+	_, err = load(t)
+	assert.ErrorContains(t, err, "DATABASE_URI_FILE")
+
+	// Only secrets are read from files
+	t.Setenv("RUN_ADDRESS_FILE", secret)
+	os.Unsetenv("DATABASE_URI")
+	c, err = load(t)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:8080", c.Server)
+}
+
+func TestLoad_Errors(t *testing.T) {
+	file := writeFile(t, "config.yaml", "run_adress: 0.0.0.0:8000\n")
+	t.Setenv("ACCRUAL_FREQUENCY", "often")
+
+	_, err := load(t, "-c", file, "-rw", "many")
+	var errs Errors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 3)
+	assert.ErrorContains(t, errs[0], "run_adress")
+	assert.ErrorContains(t, errs[1], "ACCRUAL_FREQUENCY")
+	assert.ErrorContains(t, errs[2], "-rw")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := Default()
+	valid.Database = "memory://"
+	require.NoError(t, valid.Validate())
+
+	c := Default()
+	c.AccrualService = MustParseURL("localhost:8081")
+	c.AccrualFrequency = 0
+	c.AccrualWorkers = 0
+	c.AuthCache = "signed"
+	c.LoginMaxLockout = time.Second
+	c.ShutdownDrainDelay = time.Minute
+
+	var errs Errors
+	require.True(t, errors.As(c.Validate(), &errs))
+	messages := errs.Error()
+	for _, field := range []string{"database_uri", "accrual_system_address", "accrual_frequency", "accrual_workers", "auth_signing_key", "login_max_lockout", "shutdown_drain_delay"} {
+		assert.Contains(t, messages, field)
+	}
+}
+
+func TestConfig_String(t *testing.T) {
+	tests := []struct {
+		name     string
+		database string
+		want     string
+		wantNot  string
+	}{
+		{
+			name:     "URL password",
+			database: "postgres://app:s3cret@db:5432/gophermart",
+			want:     "Database: postgres://app:xxxxx@db:5432/gophermart,",
+			wantNot:  "s3cret",
+		},
+		{
+			name:     "DSN password",
+			database: "host=db user=app password=s3cret dbname=gophermart",
+			want:     "Database: host=db user=app password=xxxxx dbname=gophermart,",
+			wantNot:  "s3cret",
+		},
+		{
+			name:     "No password",
+			database: "memory://",
+			want:     "Database: memory://,",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			c.Database = tt.database
+			c.AuthSigningKey = "k1:signing-secret"
+
+			s := c.String()
+			assert.Contains(t, s, tt.want)
+			assert.Contains(t, s, "AuthSigningKey: xxxxx,")
+			assert.NotContains(t, s, "signing-secret")
+			if tt.wantNot != "" {
+				assert.NotContains(t, s, tt.wantNot)
+			}
+		})
+	}
+}
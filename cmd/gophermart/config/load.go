@@ -0,0 +1,187 @@
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Env variable with path to config file, used if -c flag is not set
+const configFileEnv = "GOPHERMART_CONFIG"
+
+// Suffix of env variable holding path to file with value of secret field
+const fileEnvSuffix = "_FILE"
+
+// Errors lists every problem found in config, so all of them can be fixed at once
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return "bad config:\n  " + strings.Join(messages, "\n  ")
+}
+
+// Load builds config from defaults, config file, environment and flags parsed from args,
+// later source overrides earlier one. Flags are registered on fs, so caller can use
+// positional arguments. Config is not validated, errors of all sources are returned together.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	c := Default()
+
+	configFile := fs.String("c", "", "Config file, YAML or JSON, env "+configFileEnv)
+	flags := registerFlags(fs, c)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	var errs Errors
+	if *configFile == "" {
+		*configFile = os.Getenv(configFileEnv)
+	}
+	if *configFile != "" {
+		if err := c.loadFile(*configFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, c.loadEnv()...)
+	errs = append(errs, c.applyFlags(fs, flags)...)
+
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, nil
+}
+
+// loadFile overrides fields present in file, unknown keys are errors to catch typos
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	// JSON is YAML too
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv overrides fields which env variable is set. Secret field may be read from file
+// named by env variable with _FILE suffix, but not from both.
+func (c *Config) loadEnv() Errors {
+	var errs Errors
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := field.Tag.Get("env")
+
+		value, ok := os.LookupEnv(name)
+		if field.Tag.Get("secret") == "true" {
+			if path, isFile := os.LookupEnv(name + fileEnvSuffix); isFile {
+				if ok {
+					errs = append(errs, fmt.Errorf("env %s: set together with %s", name+fileEnvSuffix, name))
+					continue
+				}
+				data, err := os.ReadFile(path)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("env %s: %w", name+fileEnvSuffix, err))
+					continue
+				}
+				value, ok = strings.TrimRight(string(data), "\r\n"), true
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		if err := setValue(v.Field(i), value); err != nil {
+			errs = append(errs, fmt.Errorf("env %s: %w", name, err))
+		}
+	}
+	return errs
+}
+
+// registerFlags defines flag for every field with default from c, values are kept
+// as text and applied after env, only if flag is set
+func registerFlags(fs *flag.FlagSet, c *Config) map[string]int {
+	flags := make(map[string]int)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := field.Tag.Get("flag")
+		usage := fmt.Sprintf("%s, env %s", field.Tag.Get("usage"), field.Tag.Get("env"))
+		defaultValue := formatValue(v.Field(i))
+		if field.Tag.Get("secret") == "true" {
+			defaultValue = redact(defaultValue)
+		}
+		fs.String(name, defaultValue, usage)
+		flags[name] = i
+	}
+	return flags
+}
+
+func (c *Config) applyFlags(fs *flag.FlagSet, flags map[string]int) Errors {
+	var errs Errors
+	v := reflect.ValueOf(c).Elem()
+	fs.Visit(func(f *flag.Flag) {
+		i, ok := flags[f.Name]
+		if !ok {
+			return
+		}
+		if err := setValue(v.Field(i), f.Value.String()); err != nil {
+			errs = append(errs, fmt.Errorf("flag -%s: %w", f.Name, err))
+		}
+	})
+	return errs
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setValue parses text into field of any type used in Config
+func setValue(field reflect.Value, value string) error {
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		field.SetInt(int64(n))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// formatValue is inverse of setValue
+func formatValue(field reflect.Value) string {
+	if s, ok := field.Interface().(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprint(field.Interface())
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"aprokhorov-diploma-1/internal/hasher"
+)
+
+// Accepted by logger
+var logLevels = []string{"debug", "info", "warn", "error", "fatal", "panic"}
+
+// Validate checks whole config and returns every problem found as Errors
+func (c Config) Validate() error {
+	var errs Errors
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(isHostPort(c.Server), "run_address: %q is not ip:port", c.Server)
+	check(c.AdminAddress == "" || isHostPort(c.AdminAddress), "admin_address: %q is not ip:port", c.AdminAddress)
+	check(c.Database != "", "database_uri: is not set")
+	check(c.AccrualService.Scheme == "http" || c.AccrualService.Scheme == "https", "accrual_system_address: %q is not http(s) URL", c.AccrualService.String())
+	check(c.AccrualService.Host != "", "accrual_system_address: %q has no host", c.AccrualService.String())
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"accrual_frequency", c.AccrualFrequency},
+		{"auth_cache_timeout", c.AuthCacheTimeout},
+		{"auth_cache_housekeeper_time", c.AuthCacheHouseKeeperTime},
+		{"auth_session_max_age", c.AuthSessionMaxAge},
+		{"ledger_reconcile_time", c.LedgerReconcileTime},
+		{"login_lockout", c.LoginLockout},
+		{"login_max_lockout", c.LoginMaxLockout},
+		{"shutdown_timeout", c.ShutdownTimeout},
+	} {
+		check(d.value > 0, "%s: %v must be positive", d.name, d.value)
+	}
+	check(c.AuthSigningGrace >= 0, "auth_signing_grace: %v must not be negative", c.AuthSigningGrace)
+	check(c.ShutdownDrainDelay >= 0 && c.ShutdownDrainDelay < c.ShutdownTimeout, "shutdown_drain_delay: %v is not in 0..shutdown_timeout %v", c.ShutdownDrainDelay, c.ShutdownTimeout)
+	check(c.LoginMaxLockout >= c.LoginLockout, "login_max_lockout: %v is less than login_lockout %v", c.LoginMaxLockout, c.LoginLockout)
+
+	check(c.AccrualRegisterDays > 0, "accrual_register_days: %d must be positive", c.AccrualRegisterDays)
+	check(c.AccrualWorkers > 0, "accrual_workers: %d must be positive", c.AccrualWorkers)
+	check(c.LoginMaxFailures > 0, "login_max_failures: %d must be positive", c.LoginMaxFailures)
+	check(c.LoginMaxIPFailures > 0, "login_max_ip_failures: %d must be positive", c.LoginMaxIPFailures)
+	check(c.PasswordMinLength > 0, "password_min_length: %d must be positive", c.PasswordMinLength)
+	check(c.PasswordClasses >= 0 && c.PasswordClasses <= 4, "password_char_classes: %d is not in 0..4", c.PasswordClasses)
+
+	check(contains(logLevels, c.LogLevel), "log_level: %q is not one of %s", c.LogLevel, strings.Join(logLevels, ", "))
+	check(c.PasswordHash == hasher.Argon2id || c.PasswordHash == hasher.Bcrypt, "password_hash: %q is not argon2id or bcrypt", c.PasswordHash)
+
+	switch c.AuthCache {
+	case "memory":
+	case "postgres":
+		check(!strings.HasPrefix(c.Database, "memory://"), "auth_cache: postgres requires postgres database_uri")
+	case "signed":
+		check(c.AuthSigningKey != "", "auth_signing_key: is required by signed auth_cache")
+	default:
+		check(false, "auth_cache: %q is not memory, postgres or signed", c.AuthCache)
+	}
+
+	if c.PasswordDenyList != "" {
+		_, err := os.Stat(c.PasswordDenyList)
+		check(err == nil, "password_denylist: %v", err)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func isHostPort(address string) bool {
+	_, port, err := net.SplitHostPort(address)
+	return err == nil && port != ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -4,45 +4,41 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"aprokhorov-diploma-1/internal/logger"
 	"aprokhorov-diploma-1/internal/storage"
+	"aprokhorov-diploma-1/internal/verificator"
 )
 
 func GetBalance(s storage.Storage, log logger.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const parent string = "handlers:GetBalance"
+		log := logger.FromContext(r.Context(), log)
 
-		var userLogin loginType = "login"
-		login := r.Context().Value(userLogin)
-		l, ok := login.(string)
-		if !ok {
-			log.Error(parent, fmt.Sprintf("%v", login))
-			log.Error(parent, "Login is not string")
-			http.Error(w, "Login is not string", http.StatusInternalServerError)
+		l, err := contextLogin(r)
+		if err != nil {
+			writeError(w, r, parent, err, log)
 			return
 		}
 		balance, err := s.GetBalance(r.Context(), l)
 		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, parent, err, log)
 			return
 		}
 
-		log.Debug(parent, fmt.Sprintf("Current Balance: %f, Withdrawals: %f", balance.CurrentScore, balance.TotalWithdrawals))
+		log.Debug(parent, fmt.Sprintf("Current Balance: %v, Withdrawals: %v", balance.CurrentScore, balance.TotalWithdrawals))
 
 		json, err := json.Marshal(balance)
 		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, parent, err, log)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		_, err = w.Write(json)
 		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, parent, err, log)
 			return
 		}
 
@@ -53,35 +49,29 @@ func GetBalance(s storage.Storage, log logger.Logger) http.HandlerFunc {
 func GetWithdrawals(s storage.Storage, log logger.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const parent string = "handlers:GetWithdrawals"
+		log := logger.FromContext(r.Context(), log)
 
-		var userLogin loginType = "login"
-		login := r.Context().Value(userLogin)
-		l, ok := login.(string)
-		if !ok {
-			log.Error(parent, fmt.Sprintf("%v", login))
-			log.Error(parent, "Login is not string")
-			http.Error(w, "Login is not string", http.StatusInternalServerError)
+		l, err := contextLogin(r)
+		if err != nil {
+			writeError(w, r, parent, err, log)
 			return
 		}
 		withdrawals, err := s.GetWithdrawals(r.Context(), l)
 		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, parent, err, log)
 			return
 		}
 
 		json, err := json.Marshal(withdrawals)
 		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, parent, err, log)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		_, err = w.Write(json)
 		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, parent, err, log)
 			return
 		}
 
@@ -89,67 +79,51 @@ func GetWithdrawals(s storage.Storage, log logger.Logger) http.HandlerFunc {
 	}
 }
 
-func AddWithdraw(s storage.Storage, log logger.Logger) http.HandlerFunc {
+func AddWithdraw(s storage.Storage, v verificator.Verificator, log logger.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const parent string = "handlers:AddWithdraw"
+		log := logger.FromContext(r.Context(), log)
 
-		var userLogin loginType = "login"
-		login := r.Context().Value(userLogin)
-		l, ok := login.(string)
-		if !ok {
-			log.Error(parent, fmt.Sprintf("%v", login))
-			log.Error(parent, "Login is not string")
-			http.Error(w, "Login is not string", http.StatusInternalServerError)
+		l, err := contextLogin(r)
+		if err != nil {
+			writeError(w, r, parent, err, log)
 			return
 		}
 
 		var jsonWithdraw storage.Withdraw
 		log.Debug(parent, "Parse Json")
-		if err := json.NewDecoder(r.Body).Decode(&jsonWithdraw); err != nil {
-			log.Info(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if err := decodeJSON(r, maxJSONBody, &jsonWithdraw); err != nil {
+			writeError(w, r, parent, err, log)
 			return
 		}
 		log.Info(parent, fmt.Sprintf("%v", jsonWithdraw))
 
-		log.Debug(parent, fmt.Sprintf("Add withdraw: %f, order: %s, user: %s", jsonWithdraw.Withdraw, jsonWithdraw.OrderID, l))
-		err := s.AddWithdraw(r.Context(), l, jsonWithdraw.OrderID, jsonWithdraw.Withdraw)
-		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		// Validate order number
+		orderNo, err := strconv.ParseInt(jsonWithdraw.OrderID, 10, 64)
+		if err != nil || !v.Valid(orderNo) {
+			writeError(w, r, parent, newError(http.StatusUnprocessableEntity, "invalid_order_number", fmt.Sprintf("Bad order_no %v", jsonWithdraw.OrderID)), log)
 			return
 		}
-		log.Info(parent, "Add withdraw Successfully")
-
-		balance, err := s.GetBalance(r.Context(), l)
-		if err != nil {
-			log.Info(parent, err.Error())
-		}
 
-		log.Debug(parent, fmt.Sprintf("Current Balance: %f, Withdrawals: %f", balance.CurrentScore, balance.TotalWithdrawals))
-		newBalance := balance.CurrentScore - jsonWithdraw.Withdraw
-		newWithdraw := balance.TotalWithdrawals + jsonWithdraw.Withdraw
-
-		// Check for Balance
-		if newBalance < 0 {
-			log.Info(parent, fmt.Sprintf("Not enought score to withdraw, Current Balance: %f, Expected Withdraw: %f", balance.CurrentScore, jsonWithdraw.Withdraw))
-			http.Error(w, err.Error(), http.StatusPaymentRequired)
+		// Validate sum, non-finite numbers are rejected by money parser already
+		if jsonWithdraw.Withdraw <= 0 {
+			writeError(w, r, parent, newError(http.StatusBadRequest, "invalid_sum", fmt.Sprintf("Bad withdraw sum %v", jsonWithdraw.Withdraw)), log)
 			return
 		}
 
-		// Update Balance
-		err = s.ModifyBalance(r.Context(), l, newBalance, newWithdraw)
+		log.Debug(parent, fmt.Sprintf("Add withdraw: %v, order: %s, user: %s", jsonWithdraw.Withdraw, jsonWithdraw.OrderID, l))
+		err = s.Withdraw(r.Context(), l, jsonWithdraw.OrderID, jsonWithdraw.Withdraw)
 		if err != nil {
-			log.Info(parent, err.Error())
+			// ErrWithdrawExists and ErrInsufficientFunds are mapped to 409 and 402
+			writeError(w, r, parent, err, log)
+			return
 		}
-		log.Info(parent, "Recalc Balance Successfully")
-		log.Debug(parent, fmt.Sprintf("New Balance: %f, Withdrawals: %f", newBalance, newWithdraw))
+		log.Info(parent, "Add withdraw Successfully")
 
 		respond := []byte(`{"status": "success"}`)
 		_, err = w.Write(respond)
 		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, parent, err, log)
 			return
 		}
 	}
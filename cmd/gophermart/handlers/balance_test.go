@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"aprokhorov-diploma-1/internal/money"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddWithdraw(t *testing.T) {
+	ts := newTestServer(t, nil)
+	token := ts.register(t, "withdrawer")
+	require.NoError(t, ts.database.AdjustBalance(context.Background(), "withdrawer", money.FromFloat(100)))
+
+	tests := []struct {
+		name     string
+		body     string
+		token    string
+		wantCode int
+		wantErr  string
+	}{
+		{"Unauthorized", `{"order":"2377225624","sum":10}`, "", http.StatusUnauthorized, "unauthorized"},
+		{"Bad json", `{"order":`, token, http.StatusBadRequest, "malformed_json"},
+		{"Bad order number", `{"order":"2377225625","sum":10}`, token, http.StatusUnprocessableEntity, "invalid_order_number"},
+		{"Zero sum", `{"order":"2377225624","sum":0}`, token, http.StatusBadRequest, "invalid_sum"},
+		{"Negative sum", `{"order":"2377225624","sum":-5}`, token, http.StatusBadRequest, "invalid_sum"},
+		{"Success", `{"order":"2377225624","sum":60.5}`, token, http.StatusOK, ""},
+		{"Duplicate order", `{"order":"2377225624","sum":1}`, token, http.StatusConflict, "withdraw_exists"},
+		{"Insufficient funds", `{"order":"12345678903","sum":40}`, token, http.StatusPaymentRequired, "insufficient_funds"},
+		{"Rest of balance", `{"order":"12345678903","sum":39.5}`, token, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := ts.do(http.MethodPost, "/api/user/balance/withdraw", tt.body, tt.token)
+			assert.Equal(t, tt.wantCode, w.Code, w.Body.String())
+			if tt.wantErr != "" {
+				var body APIError
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+				assert.Equal(t, tt.wantErr, body.Code)
+			}
+		})
+	}
+
+	balance, err := ts.database.GetBalance(context.Background(), "withdrawer")
+	require.NoError(t, err)
+	assert.Equal(t, money.Money(0), balance.CurrentScore)
+	assert.Equal(t, money.FromFloat(100), balance.TotalWithdrawals)
+}
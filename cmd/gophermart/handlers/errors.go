@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"aprokhorov-diploma-1/cmd/gophermart/accrual"
+	"aprokhorov-diploma-1/internal/cache"
+	"aprokhorov-diploma-1/internal/logger"
+	"aprokhorov-diploma-1/internal/storage"
+	"aprokhorov-diploma-1/internal/verificator"
+)
+
+// APIError is body of every error response
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+	Details   any    `json:"details,omitempty"`
+}
+
+// HTTPError is error made by handler itself, it is sent to client as is
+type HTTPError struct {
+	Status     int
+	Code       string
+	Message    string
+	Details    any
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
+
+func newError(status int, code string, message string) *HTTPError {
+	return &HTTPError{Status: status, Code: code, Message: message}
+}
+
+func validationError(violations []verificator.Violation) *HTTPError {
+	return &HTTPError{
+		Status:  http.StatusBadRequest,
+		Code:    "validation_failed",
+		Message: "Validation failed",
+		Details: violations,
+	}
+}
+
+// typedErrors maps errors of storage, cache and accrual service to responses, their text is safe to show
+var typedErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{storage.ErrUserExists, http.StatusConflict, "login_taken"},
+	{storage.ErrOrderExists, http.StatusConflict, "order_exists"},
+	{storage.ErrWithdrawExists, http.StatusConflict, "withdraw_exists"},
+	{storage.ErrOrdersInProgress, http.StatusConflict, "orders_in_progress"},
+	{storage.ErrInsufficientFunds, http.StatusPaymentRequired, "insufficient_funds"},
+	{sql.ErrNoRows, http.StatusNotFound, "not_found"},
+	{cache.ErrSessionNotFound, http.StatusNotFound, "session_not_found"},
+	{cache.ErrNotSupported, http.StatusNotImplemented, "not_supported"},
+	{accrual.ErrOrderNotRegistered, http.StatusNotFound, "order_not_registered"},
+	{errBodyTooLarge, http.StatusRequestEntityTooLarge, "body_too_large"},
+}
+
+// toHTTPError maps err to response, unknown errors become internal ones without their text
+func toHTTPError(err error) *HTTPError {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr
+	}
+
+	var rateLimit *accrual.RateLimitError
+	if errors.As(err, &rateLimit) {
+		return &HTTPError{
+			Status:     http.StatusServiceUnavailable,
+			Code:       "accrual_unavailable",
+			Message:    "Accrual service is busy, try later",
+			RetryAfter: rateLimit.RetryAfter,
+		}
+	}
+
+	for _, typed := range typedErrors {
+		if errors.Is(err, typed.err) {
+			return newError(typed.status, typed.code, typed.err.Error())
+		}
+	}
+
+	return newError(http.StatusInternalServerError, "internal_error", "Internal server error")
+}
+
+// writeError logs err and responds with APIError, server errors are logged as errors, client ones as info
+func writeError(w http.ResponseWriter, r *http.Request, parent string, err error, log logger.Logger) {
+	httpErr := toHTTPError(err)
+	if httpErr.Status >= http.StatusInternalServerError && httpErr.Status != http.StatusNotImplemented {
+		log.Error(parent, err.Error())
+	} else {
+		log.Info(parent, err.Error())
+	}
+
+	body, err := json.Marshal(APIError{
+		Code:      httpErr.Code,
+		Message:   httpErr.Message,
+		RequestID: logger.RequestID(r.Context()),
+		Details:   httpErr.Details,
+	})
+	if err != nil {
+		log.Error(parent, err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if httpErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(httpErr.RetryAfter.Seconds()))))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(httpErr.Status)
+	_, err = w.Write(body)
+	if err != nil {
+		log.Error(parent, err.Error())
+	}
+}
+
+// errNoLogin is returned when handler is mounted without AuthMiddleware
+var errNoLogin = errors.New("cannot get valid login from context")
+
+// contextLogin returns login stored by AuthMiddleware
+func contextLogin(r *http.Request) (string, error) {
+	login, ok := r.Context().Value(loginType("login")).(string)
+	if !ok {
+		return "", errNoLogin
+	}
+	return login, nil
+}
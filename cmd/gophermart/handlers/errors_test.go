@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aprokhorov-diploma-1/cmd/gophermart/accrual"
+	"aprokhorov-diploma-1/internal/logger"
+	"aprokhorov-diploma-1/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteError(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantCode       string
+		wantMessage    string
+		wantRetryAfter string
+	}{
+		{
+			name:        "Typed storage error",
+			err:         fmt.Errorf("withdraw: %w", storage.ErrInsufficientFunds),
+			wantStatus:  http.StatusPaymentRequired,
+			wantCode:    "insufficient_funds",
+			wantMessage: storage.ErrInsufficientFunds.Error(),
+		},
+		{
+			name:        "Handler error",
+			err:         newError(http.StatusUnprocessableEntity, "invalid_order_number", "Bad order_no 1"),
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantCode:    "invalid_order_number",
+			wantMessage: "Bad order_no 1",
+		},
+		{
+			name:           "Accrual rate limit",
+			err:            &accrual.RateLimitError{RetryAfter: 60 * time.Second},
+			wantStatus:     http.StatusServiceUnavailable,
+			wantCode:       "accrual_unavailable",
+			wantMessage:    "Accrual service is busy, try later",
+			wantRetryAfter: "60",
+		},
+		{
+			name:        "Unknown error is not leaked",
+			err:         errors.New(`pq: relation "users" does not exist`),
+			wantStatus:  http.StatusInternalServerError,
+			wantCode:    "internal_error",
+			wantMessage: "Internal server error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+
+			writeError(w, r, "test", tt.err, log)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.Equal(t, tt.wantRetryAfter, w.Header().Get("Retry-After"))
+
+			var body APIError
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tt.wantCode, body.Code)
+			assert.Equal(t, tt.wantMessage, body.Message)
+		})
+	}
+}
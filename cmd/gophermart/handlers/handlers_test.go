@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aprokhorov-diploma-1/internal/cache"
+	"aprokhorov-diploma-1/internal/hasher"
+	"aprokhorov-diploma-1/internal/logger"
+	"aprokhorov-diploma-1/internal/storage"
+	"aprokhorov-diploma-1/internal/throttle"
+	"aprokhorov-diploma-1/internal/verificator"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+)
+
+const testPassword = "Gopher-Mart-42"
+
+// testServer is gophermart API over memory:// storage, routes are the same as in main
+type testServer struct {
+	handler  http.Handler
+	database *storage.Memory
+	cache    cache.AuthCache
+}
+
+// newTestServer builds server with AuthCache made by newCache, memory one if it is nil
+func newTestServer(t *testing.T, newCache func(database *storage.Memory, log logger.Logger) cache.AuthCache) *testServer {
+	log, _ := logger.NewZeroLogger("error")
+	database := storage.NewMemory()
+	ac := cache.AuthCache(cache.NewMemCache(time.Hour, log))
+	if newCache != nil {
+		ac = newCache(database, log)
+	}
+	h, err := hasher.NewHMACWithPassword(hasher.Bcrypt)
+	require.NoError(t, err)
+	luhn, err := verificator.NewLuhn()
+	require.NoError(t, err)
+	throttler := throttle.New(throttle.NewMemStore(), throttle.DefaultPolicy(), log)
+	policy := verificator.DefaultCredentialsPolicy()
+
+	r := chi.NewRouter()
+	r.Use(RequestID(log))
+	r.Route("/api/user", func(r chi.Router) {
+		r.Route("/", func(r chi.Router) {
+			r.Use(CheckHeaders(log))
+			r.Post("/register", Authorize(true, database, ac, h, throttler, policy, log))
+			r.Post("/login", Authorize(false, database, ac, h, throttler, policy, log))
+			r.With(AuthMiddleware(ac, log)).Post("/password", ChangePassword(database, ac, h, policy, log))
+			r.With(AuthMiddleware(ac, log)).Delete("/", DeleteUser(database, ac, log))
+		})
+		r.Route("/balance", func(r chi.Router) {
+			r.Use(CheckHeaders(log))
+			r.Use(AuthMiddleware(ac, log))
+			r.Get("/", GetBalance(database, log))
+			r.Post("/withdraw", AddWithdraw(database, luhn, log))
+		})
+		r.Route("/logout", func(r chi.Router) {
+			r.Use(AuthMiddleware(ac, log))
+			r.Post("/", Logout(ac, log))
+		})
+		r.Route("/sessions", func(r chi.Router) {
+			r.Use(AuthMiddleware(ac, log))
+			r.Get("/", GetSessions(ac, log))
+			r.Delete("/", DeleteSessions(ac, log))
+			r.Delete("/{id}", DeleteSession(ac, log))
+		})
+	})
+
+	return &testServer{handler: r, database: database, cache: ac}
+}
+
+// do sends request with auth token, if any
+func (ts *testServer) do(method string, path string, body string, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		request.AddCookie(&http.Cookie{Name: "GOPHER_MARKET_AUTH", Value: token})
+	}
+	w := httptest.NewRecorder()
+	ts.handler.ServeHTTP(w, request)
+	return w
+}
+
+// register creates user and returns its auth token
+func (ts *testServer) register(t *testing.T, login string) string {
+	w := ts.do(http.MethodPost, "/api/user/register", `{"login":"`+login+`","password":"`+testPassword+`"}`, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	token := authCookie(w)
+	require.NotEmpty(t, token)
+	return token
+}
+
+// login opens new session of user and returns response
+func (ts *testServer) login(login string, password string) *httptest.ResponseRecorder {
+	return ts.do(http.MethodPost, "/api/user/login", `{"login":"`+login+`","password":"`+password+`"}`, "")
+}
+
+// signedCache makes stateless AuthCache with token versions kept in database
+func signedCache(database *storage.Memory, log logger.Logger) cache.AuthCache {
+	key := cache.SigningKey{ID: "k1", Secret: "test-secret"}
+	return cache.NewSignedCache(hasher.NewHMAC(), key, cache.SigningKey{}, 0, time.Hour, 24*time.Hour, storage.NewTokenVersions(database), log)
+}
+
+// authCookie returns value of auth cookie set by response, empty if it is not set
+func authCookie(w *httptest.ResponseRecorder) string {
+	if cookie := findAuthCookie(w); cookie != nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func findAuthCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "GOPHER_MARKET_AUTH" {
+			return cookie
+		}
+	}
+	return nil
+}
@@ -2,8 +2,12 @@ package handlers
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"net/http"
+	"regexp"
 	"time"
 
 	"aprokhorov-diploma-1/internal/cache"
@@ -12,15 +16,48 @@ import (
 
 type loginType string
 
+// Header carrying id of request, taken from client or generated
+const requestIDHeader = "X-Request-Id"
+
+// Client request id is trusted only if it is short and safe to put in logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID puts id of request to response header and to context together with logger carrying it,
+// so every log line about request can be found by id
+func RequestID(log logger.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(requestIDHeader)
+			if !validRequestID.MatchString(id) {
+				id = newRequestID()
+			}
+			w.Header().Set(requestIDHeader, id)
+
+			ctx := logger.WithRequestID(r.Context(), id)
+			ctx = logger.NewContext(ctx, log.With("request_id", id))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// newRequestID generates random id of request
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
 func CheckHeaders(log logger.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			const parent = "middleware:checkContentType"
+			log := logger.FromContext(r.Context(), log)
 			if r.Method == http.MethodPost {
 				if r.Header.Get("Content-Type") != "application/json" {
-					log.Info(parent, "Request not 'application/json'")
 					errorText := fmt.Sprintf("only application/json supported, get %s", r.Header.Get("Content-Type"))
-					http.Error(w, errorText, http.StatusNotImplemented)
+					writeError(w, r, parent, newError(http.StatusNotImplemented, "unsupported_content_type", errorText), log)
 					return
 				}
 			}
@@ -35,47 +72,64 @@ func AuthMiddleware(ac cache.AuthCache, log logger.Logger) func(http.Handler) ht
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			const parent string = "Middleware:Auth"
+			log := logger.FromContext(r.Context(), log)
 
 			reqToken, err := r.Cookie("GOPHER_MARKET_AUTH")
-			log.Debug(parent, fmt.Sprintf("%v", r.Cookies()))
 			if err != nil {
-				log.Info(parent, err.Error())
 				log.Info(parent, "Unauthorized request, token missed")
-				http.Error(w, `{"result":"Please, Log In"}`, http.StatusUnauthorized)
+				writeError(w, r, parent, newError(http.StatusUnauthorized, "unauthorized", "Please, Log In"), log)
 				return
 			}
 
-			login, err := ac.GetTokenUser(reqToken.Value)
+			// Stateless token is verified once and reissued to slide expiry within session max age,
+			// stored one is refreshed below
+			var login string
+			token := reqToken.Value
+			if issuer, ok := ac.(cache.TokenIssuer); ok {
+				login, token, err = issuer.ReissueToken(r.Context(), reqToken.Value)
+			} else {
+				login, err = ac.GetTokenUser(reqToken.Value)
+			}
 			if err != nil {
 				log.Info(parent, err.Error())
-				http.Error(w, `{"result":"Unauthorized"}`, http.StatusUnauthorized)
+				writeError(w, r, parent, newError(http.StatusUnauthorized, "unauthorized", "Unauthorized request, token invalid or expired"), log)
 				return
 			}
 			if login == "" {
-				log.Info(parent, fmt.Sprintf("Can't find Login for token: %s", reqToken.Value))
-				http.Error(w, `{"result":"Unauthorized request, token invalid or expired"}`, http.StatusUnauthorized)
+				writeError(w, r, parent, newError(http.StatusUnauthorized, "unauthorized", "Unauthorized request, token invalid or expired"), log)
 				return
 			}
 
-			//Store Login in Context for user in Handlers
+			//Store Login in Context for user in Handlers, log lines of handlers carry it too
 			var userLogin loginType = "login"
-			r = r.WithContext(context.WithValue(r.Context(), userLogin, login))
+			log = log.With("login", login)
+			ctx := context.WithValue(r.Context(), userLogin, login)
+			r = r.WithContext(logger.NewContext(ctx, log))
 
 			// Update Cookie to Refresh "Expires"
 			//init the loc
 			loc, _ := time.LoadLocation("Europe/Moscow")
 			//set timezone
 			expires := time.Now().In(loc).Add(ac.GetLifetime())
-			newCookie := http.Cookie{Name: "GOPHER_MARKET_AUTH", Value: reqToken.Value, Expires: expires}
+			newCookie := http.Cookie{Name: "GOPHER_MARKET_AUTH", Value: token, Path: "/api", Expires: expires}
 			http.SetCookie(w, &newCookie)
 
-			next.ServeHTTP(w, r)
-
-			// refresh timeout in AuthCache
-			err = ac.StoreToken(login, reqToken.Value)
+			// refresh timeout in AuthCache, session revoked by handler is not restored
+			err = ac.RefreshToken(reqToken.Value)
 			if err != nil {
 				log.Error(parent, err.Error())
 			}
+
+			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// sessionMeta describes client of request for session list
+func sessionMeta(r *http.Request) cache.SessionMeta {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return cache.SessionMeta{UserAgent: r.UserAgent(), IP: ip}
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"aprokhorov-diploma-1/internal/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestID(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+
+	tests := []struct {
+		name      string
+		requestID string
+		wantSame  bool
+	}{
+		{
+			name:      "Client id is kept",
+			requestID: "client-42.a_b",
+			wantSame:  true,
+		},
+		{
+			name:      "Missed id is generated",
+			requestID: "",
+			wantSame:  false,
+		},
+		{
+			name:      "Unsafe id is replaced",
+			requestID: "bad id\n",
+			wantSame:  false,
+		},
+		{
+			name:      "Too long id is replaced",
+			requestID: strings.Repeat("a", 65),
+			wantSame:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ctxID string
+			var ctxLog logger.Logger
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctxID = logger.RequestID(r.Context())
+				ctxLog = logger.FromContext(r.Context(), nil)
+				writeError(w, r, "test", newError(http.StatusBadRequest, "bad_request", "Bad request"), ctxLog)
+			})
+
+			request := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+			if tt.requestID != "" {
+				request.Header.Set(requestIDHeader, tt.requestID)
+			}
+			w := httptest.NewRecorder()
+			RequestID(log)(next).ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+
+			id := result.Header.Get(requestIDHeader)
+			require.NotEmpty(t, id)
+			assert.Equal(t, id, ctxID)
+			assert.NotNil(t, ctxLog)
+			if tt.wantSame {
+				assert.Equal(t, tt.requestID, id)
+			} else {
+				assert.NotEqual(t, tt.requestID, id)
+				assert.Regexp(t, "^[0-9a-f]{16}$", id)
+			}
+
+			var body APIError
+			require.NoError(t, json.NewDecoder(result.Body).Decode(&body))
+			assert.Equal(t, id, body.RequestID)
+		})
+	}
+}
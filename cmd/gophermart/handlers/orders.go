@@ -17,71 +17,64 @@ import (
 func NewOrder(s storage.Storage, v verificator.Verificator, log logger.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const parent string = "handlers:NewOrder"
-		loginAny := r.Context().Value(loginType("login"))
-		login, ok := loginAny.(string)
-		if !ok {
-			log.Error(parent, "Cannot get valid login from Context")
-			http.Error(w, "Cannot get valid login from Context", http.StatusInternalServerError)
+		log := logger.FromContext(r.Context(), log)
+		login, err := contextLogin(r)
+		if err != nil {
+			writeError(w, r, parent, err, log)
 			return
 		}
 		// Check Header for context-type
 		if r.Header.Get("Content-Type") != "text/plain" {
-			log.Info(parent, "Request not 'text/plain'")
 			errorText := fmt.Sprintf("only text/plain supported, get %s", r.Header.Get("Content-Type"))
-			http.Error(w, errorText, http.StatusBadRequest)
+			writeError(w, r, parent, newError(http.StatusBadRequest, "unsupported_content_type", errorText), log)
 			return
 		}
 		// Try to read raw order data
 		orderRaw, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.Info(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, parent, err, log)
 			return
 		}
 		r.Body.Close()
 		// Convert order raw data to integer
 		orderNo, err := strconv.ParseInt(string(orderRaw), 10, 64)
 		if err != nil {
-			log.Info(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeError(w, r, parent, newError(http.StatusUnprocessableEntity, "invalid_order_number", err.Error()), log)
 			return
 		}
 		// Validate order number
 		valid := v.Valid(orderNo)
 		if !valid {
-			log.Info(parent, fmt.Sprintf("Bad order_no %v", orderNo))
-			http.Error(w, fmt.Sprintf("Bad order_no %v", orderNo), http.StatusUnprocessableEntity)
+			writeError(w, r, parent, newError(http.StatusUnprocessableEntity, "invalid_order_number", fmt.Sprintf("Bad order_no %v", orderNo)), log)
 			return
 		}
 		// Lookup in Storage for this Order and check for existance
 		localOrder, err := s.GetOrder(r.Context(), string(orderRaw))
 		if err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
-				log.Error(parent, err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeError(w, r, parent, err, log)
 				return
 			}
 			// No Rows, Create New Order
 			log.Debug(parent, fmt.Sprintf("No order %v yet, create some", orderNo))
 			err := s.AddOrder(r.Context(), login, string(orderRaw))
 			if err != nil {
-				log.Error(parent, err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeError(w, r, parent, err, log)
 				return
 			}
-			http.Error(w, "Success", http.StatusAccepted)
 			log.Info(parent, fmt.Sprintf("Create order %v for %v successfully", orderNo, login))
+			writeText(w, http.StatusAccepted, "Success", parent, log)
 			return
 		}
 		// If Order exist already - check why
 		if !errors.Is(err, sql.ErrNoRows) {
 			if localOrder.Login != login {
 				log.Info(parent, fmt.Sprintf("User:%v try to upload order{%v} that have been uploaded by user:%v", login, orderNo, localOrder.Login))
-				http.Error(w, fmt.Sprintf("Order: %v alredy have been uploaded by another User", orderNo), http.StatusConflict)
+				writeError(w, r, parent, newError(http.StatusConflict, "order_exists", fmt.Sprintf("Order: %v alredy have been uploaded by another User", orderNo)), log)
 				return
 			} else {
 				log.Info(parent, fmt.Sprintf("User:%v try to upload order{%v} that have been uploaded by himself", login, orderNo))
-				http.Error(w, fmt.Sprintf("Order %v already have been uploaded by you", orderNo), http.StatusOK)
+				writeText(w, http.StatusOK, fmt.Sprintf("Order %v already have been uploaded by you", orderNo), parent, log)
 				return
 			}
 		}
@@ -91,11 +84,10 @@ func NewOrder(s storage.Storage, v verificator.Verificator, log logger.Logger) h
 func GetOrders(s storage.Storage, log logger.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const parent string = "handlers:GetOrder"
-		loginAny := r.Context().Value(loginType("login"))
-		login, ok := loginAny.(string)
-		if !ok {
-			log.Error(parent, "Cannot get valid login from Context")
-			http.Error(w, "Cannot get valid login from Context", http.StatusInternalServerError)
+		log := logger.FromContext(r.Context(), log)
+		login, err := contextLogin(r)
+		if err != nil {
+			writeError(w, r, parent, err, log)
 			return
 		}
 
@@ -103,33 +95,39 @@ func GetOrders(s storage.Storage, log logger.Logger) http.HandlerFunc {
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				log.Info(parent, fmt.Sprintf("User:%v No Orders", login))
-				http.Error(w, "No Orders", http.StatusNoContent)
+				w.WriteHeader(http.StatusNoContent)
 				return
 			}
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusNoContent)
+			writeError(w, r, parent, err, log)
 			return
 		}
 
 		if len(orders) == 0 {
 			log.Info(parent, fmt.Sprintf("User:%v No Orders", login))
-			http.Error(w, "No Orders", http.StatusNoContent)
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
 		ordersJSON, err := json.MarshalIndent(orders, "", "  ")
 		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, parent, err, log)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		_, err = w.Write(ordersJSON)
 		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, parent, err, log)
 			return
 		}
 	}
 }
+
+// writeText responds with plain text message
+func writeText(w http.ResponseWriter, status int, message string, parent string, log logger.Logger) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(message)); err != nil {
+		log.Error(parent, err.Error())
+	}
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"aprokhorov-diploma-1/internal/cache"
+	"aprokhorov-diploma-1/internal/logger"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Logout revokes token of current session and drops auth cookie. Signed token can't be
+// revoked alone, so logout with signed tokens revokes all of them and ends sessions on every device.
+func Logout(ac cache.AuthCache, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const parent string = "handlers:Logout"
+		log := logger.FromContext(r.Context(), log)
+
+		reqToken, err := r.Cookie("GOPHER_MARKET_AUTH")
+		if err != nil {
+			writeError(w, r, parent, newError(http.StatusUnauthorized, "unauthorized", "Please, Log In"), log)
+			return
+		}
+
+		err = ac.RevokeToken(reqToken.Value)
+		if errors.Is(err, cache.ErrNotSupported) {
+			login, loginErr := contextLogin(r)
+			if loginErr != nil {
+				writeError(w, r, parent, loginErr, log)
+				return
+			}
+			log.Info(parent, "Single token can't be revoked, all sessions of user are ended")
+			err = ac.RevokeSessions(login, "")
+		}
+		if err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+		dropAuthCookie(w)
+
+		_, err = w.Write([]byte(`{"status": "success"}`))
+		if err != nil {
+			log.Error(parent, err.Error())
+		}
+	}
+}
+
+// GetSessions lists active sessions of user, current one is marked
+func GetSessions(ac cache.AuthCache, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const parent string = "handlers:GetSessions"
+		log := logger.FromContext(r.Context(), log)
+
+		login, err := contextLogin(r)
+		if err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+
+		sessions, err := ac.GetSessions(login)
+		if err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+
+		if reqToken, err := r.Cookie("GOPHER_MARKET_AUTH"); err == nil {
+			current := cache.SessionID(reqToken.Value)
+			for i := range sessions {
+				sessions[i].Current = sessions[i].ID == current
+			}
+		}
+
+		body, err := json.Marshal(sessions)
+		if err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(body)
+		if err != nil {
+			log.Error(parent, err.Error())
+		}
+	}
+}
+
+// DeleteSession revokes one session of user by its id
+func DeleteSession(ac cache.AuthCache, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const parent string = "handlers:DeleteSession"
+		log := logger.FromContext(r.Context(), log)
+
+		login, err := contextLogin(r)
+		if err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+
+		if err := ac.RevokeSession(login, chi.URLParam(r, "id")); err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+		log.Info(parent, fmt.Sprintf("Session revoked for User: %s", login))
+
+		_, err = w.Write([]byte(`{"status": "success"}`))
+		if err != nil {
+			log.Error(parent, err.Error())
+		}
+	}
+}
+
+// DeleteSessions logs user out everywhere, current session included
+func DeleteSessions(ac cache.AuthCache, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const parent string = "handlers:DeleteSessions"
+		log := logger.FromContext(r.Context(), log)
+
+		login, err := contextLogin(r)
+		if err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+
+		if err := ac.RevokeSessions(login, ""); err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+		dropAuthCookie(w)
+		log.Info(parent, fmt.Sprintf("All Sessions revoked for User: %s", login))
+
+		_, err = w.Write([]byte(`{"status": "success"}`))
+		if err != nil {
+			log.Error(parent, err.Error())
+		}
+	}
+}
+
+// dropAuthCookie expires auth cookie
+func dropAuthCookie(w http.ResponseWriter) {
+	setAuthCookie(w, &http.Cookie{Name: "GOPHER_MARKET_AUTH", Value: "", Path: "/api", MaxAge: -1})
+}
+
+// setAuthCookie sets auth cookie, cookie refreshed by AuthMiddleware is replaced
+func setAuthCookie(w http.ResponseWriter, cookie *http.Cookie) {
+	var kept []string
+	for _, value := range w.Header().Values("Set-Cookie") {
+		if !strings.HasPrefix(value, cookie.Name+"=") {
+			kept = append(kept, value)
+		}
+	}
+	w.Header().Del("Set-Cookie")
+	for _, value := range kept {
+		w.Header().Add("Set-Cookie", value)
+	}
+	http.SetCookie(w, cookie)
+}
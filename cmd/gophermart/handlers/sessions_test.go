@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"aprokhorov-diploma-1/internal/cache"
+	"aprokhorov-diploma-1/internal/logger"
+	"aprokhorov-diploma-1/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogout(t *testing.T) {
+	tests := []struct {
+		name     string
+		newCache func(database *storage.Memory, log logger.Logger) cache.AuthCache
+		// Code of request made with token of other session after logout
+		wantOther int
+	}{
+		{
+			name:      "Memory AuthCache revokes token",
+			newCache:  nil,
+			wantOther: http.StatusOK,
+		},
+		{
+			name:      "Signed AuthCache revokes tokens of all sessions",
+			newCache:  signedCache,
+			wantOther: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, tt.newCache)
+			token := ts.register(t, "leaver")
+			w := ts.login("leaver", testPassword)
+			require.Equal(t, http.StatusOK, w.Code)
+			other := authCookie(w)
+
+			w = ts.do(http.MethodPost, "/api/user/logout", "", "")
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+			w = ts.do(http.MethodPost, "/api/user/logout", "", token)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			cookie := findAuthCookie(w)
+			require.NotNil(t, cookie)
+			assert.Empty(t, cookie.Value)
+			assert.Less(t, cookie.MaxAge, 0)
+
+			w = ts.do(http.MethodGet, "/api/user/balance", "", token)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			w = ts.do(http.MethodGet, "/api/user/balance", "", other)
+			assert.Equal(t, tt.wantOther, w.Code)
+		})
+	}
+}
+
+func TestSessions(t *testing.T) {
+	ts := newTestServer(t, nil)
+	first := ts.register(t, "traveller")
+	w := ts.login("traveller", testPassword)
+	require.Equal(t, http.StatusOK, w.Code)
+	second := authCookie(w)
+
+	w = ts.do(http.MethodGet, "/api/user/sessions", "", first)
+	require.Equal(t, http.StatusOK, w.Code)
+	var sessions []cache.Session
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 2)
+	for _, session := range sessions {
+		assert.Equal(t, session.ID == cache.SessionID(first), session.Current)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		wantCode int
+	}{
+		{"Unknown session", http.MethodDelete, "/api/user/sessions/unknown", first, http.StatusNotFound},
+		{"Other session", http.MethodDelete, "/api/user/sessions/" + cache.SessionID(second), first, http.StatusOK},
+		{"Revoked session", http.MethodGet, "/api/user/sessions", second, http.StatusUnauthorized},
+		{"Log out everywhere", http.MethodDelete, "/api/user/sessions", first, http.StatusOK},
+		{"Logged out everywhere", http.MethodGet, "/api/user/sessions", first, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := ts.do(tt.method, tt.path, "", tt.token)
+			assert.Equal(t, tt.wantCode, w.Code, w.Body.String())
+		})
+	}
+}
@@ -2,53 +2,61 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"aprokhorov-diploma-1/internal/cache"
 	"aprokhorov-diploma-1/internal/hasher"
 	"aprokhorov-diploma-1/internal/logger"
 	"aprokhorov-diploma-1/internal/storage"
+	"aprokhorov-diploma-1/internal/throttle"
+	"aprokhorov-diploma-1/internal/verificator"
 )
 
-func Authorize(register bool, s storage.Storage, ac cache.AuthCache, hasher hasher.Hasher, log logger.Logger) http.HandlerFunc {
+func Authorize(register bool, s storage.Storage, ac cache.AuthCache, hasher hasher.Hasher, th *throttle.Throttler, policy verificator.CredentialsPolicy, log logger.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const parent = "handlers:Authorize"
+		log := logger.FromContext(r.Context(), log)
 
 		log.Debug(parent, "New Request") // Migrate to middleware Access.log
 
 		// Parse JSON from Request
 		var jsonUser storage.User
 		log.Debug(parent, "Parse Json")
-		if err := json.NewDecoder(r.Body).Decode(&jsonUser); err != nil {
-			log.Info(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if err := decodeJSON(r, maxCredentialsBody, &jsonUser); err != nil {
+			writeError(w, r, parent, err, log)
 			return
 		}
 
-		// Generate hash with Random Key for password
-		key, err := hasher.RandomKey()
-		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		// Policy applies to new users only, existing ones just need both fields
+		var violations []verificator.Violation
+		if register {
+			violations = policy.Validate(jsonUser.Login, jsonUser.Password)
+		} else {
+			violations = requireCredentials(jsonUser.Login, jsonUser.Password)
+		}
+		if len(violations) > 0 {
+			writeError(w, r, parent, validationError(violations), log)
 			return
 		}
-		jsonUser.PassHash = hasher.GetHash(jsonUser.Password, key)
 
+		var err error
 		if register {
+			// Hash password, salt and parameters are kept inside encoded hash
+			jsonUser.PassHash, err = hasher.HashPassword(jsonUser.Password)
+			if err != nil {
+				writeError(w, r, parent, err, log)
+				return
+			}
+
 			// Register User in Database
 			log.Debug(parent, fmt.Sprintf("Try to Register User: %s", jsonUser.Login))
-			if err := s.RegisterUser(r.Context(), jsonUser.Login, jsonUser.PassHash, key); err != nil {
-				if strings.Contains(err.Error(), "(SQLSTATE 23505)") {
-					log.Info(parent, fmt.Sprintf("Already exists User with Login: %s", jsonUser.Login))
-					http.Error(w, `{"result":"Login Already Used, choose another"}`, http.StatusConflict)
-					return
-				}
-				log.Error(parent, err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if err := s.RegisterUser(r.Context(), jsonUser.Login, jsonUser.PassHash, ""); err != nil {
+				// ErrUserExists is mapped to 409
+				writeError(w, r, parent, err, log)
 				return
 			}
 			log.Debug(parent, fmt.Sprintf("Successfully Register User: %s", jsonUser.Login))
@@ -56,54 +64,83 @@ func Authorize(register bool, s storage.Storage, ac cache.AuthCache, hasher hash
 			// Create Start Balance for User
 			log.Debug(parent, fmt.Sprintf("Try to create Balance for User: %s", jsonUser.Login))
 			if err := s.AddBalance(r.Context(), jsonUser.Login, 0, 0); err != nil {
-				log.Error(parent, err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeError(w, r, parent, err, log)
 				return
 			}
 			log.Debug(parent, fmt.Sprintf("Successfully created Balance for User: %s", jsonUser.Login))
 		} else {
+			// Attempt is counted before password check, so parallel requests can't get around lockout.
+			// Locked out login or IP is refused without password check.
+			ip := sessionMeta(r).IP
+			retryAfter, err := th.Attempt(r.Context(), jsonUser.Login, ip)
+			if err != nil {
+				writeError(w, r, parent, err, log)
+				return
+			}
+			if retryAfter > 0 {
+				log.Info(parent, fmt.Sprintf("Locked out Login Attempt on Login: %s from %s", jsonUser.Login, ip))
+				writeError(w, r, parent, &HTTPError{
+					Status:     http.StatusTooManyRequests,
+					Code:       "too_many_attempts",
+					Message:    "Too many failed login attempts, try later",
+					RetryAfter: retryAfter,
+				}, log)
+				return
+			}
+
 			// If not register, then validate login/pass pair from Storage
-			pass, err := validatePass(r.Context(), s, hasher, jsonUser.Login, jsonUser.Password)
+			login, pass, err := validatePass(r.Context(), s, hasher, jsonUser.Login, jsonUser.Password, log)
 			if err != nil {
-				log.Error(parent, err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeError(w, r, parent, err, log)
 				return
 			}
 
 			if !pass {
 				log.Info(parent, fmt.Sprintf("Failed Login Attempt on Login: %s", jsonUser.Login))
-				http.Error(w, `{"result":"Bad login/password"}`, http.StatusUnauthorized)
+				writeError(w, r, parent, newError(http.StatusUnauthorized, "invalid_credentials", "Bad login/password"), log)
 				return
 			}
+
+			if err := th.Success(r.Context(), jsonUser.Login, ip); err != nil {
+				log.Error(parent, err.Error())
+			}
+			// Session belongs to login as it has been registered, whatever case it is typed in
+			jsonUser.Login = login
 		}
 
 		// Authorize User in AuthCache
 		log.Debug(parent, fmt.Sprintf("Try to authorize User: %s", jsonUser.Login))
 
-		token, err := hasher.RandomKey()
-		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		var token string
+		if issuer, ok := ac.(cache.TokenIssuer); ok {
+			// Stateless AuthCache signs token itself
+			token, err = issuer.IssueToken(r.Context(), jsonUser.Login)
+			if err != nil {
+				writeError(w, r, parent, err, log)
+				return
+			}
+		} else {
+			token, err = hasher.GenerateToken()
+			if err != nil {
+				writeError(w, r, parent, err, log)
+				return
+			}
 
-		err = ac.StoreToken(jsonUser.Login, token)
-		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			err = ac.StoreToken(jsonUser.Login, token, sessionMeta(r))
+			if err != nil {
+				writeError(w, r, parent, err, log)
+				return
+			}
 		}
 		// Check Auth after Authorizing
 		login, err := ac.GetTokenUser(token)
 		if err != nil {
-			log.Error(parent, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, parent, err, log)
 			return
 		}
 
 		if login == "" {
-			log.Error(parent, "Unexceptable behavior, user not authorized")
-			http.Error(w, "Unexceptable behavior, user not authorized", http.StatusInternalServerError)
+			writeError(w, r, parent, errors.New("unexceptable behavior, user not authorized"), log)
 			return
 		}
 		log.Debug(parent, fmt.Sprintf("Successfully authorize User: %s", jsonUser.Login))
@@ -125,23 +162,157 @@ func Authorize(register bool, s storage.Storage, ac cache.AuthCache, hasher hash
 	}
 }
 
-func getLogin(r *http.Request, ac cache.AuthCache) string {
-	requestCookies, _ := r.Cookie("GOPHER_MARKET_AUTH")
-	login, _ := ac.GetTokenUser(requestCookies.Value)
-	return login
-}
+// validatePass checks password of user and returns login as it has been registered.
+// Hash is upgraded if it was made with legacy HMAC or with other algorithm than configured
+func validatePass(ctx context.Context, s storage.Storage, hash hasher.Hasher, login string, password string, log logger.Logger) (string, bool, error) {
+	const parent = "handlers:validatePass"
 
-func validatePass(ctx context.Context, s storage.Storage, hash hasher.Hasher, login string, password string) (bool, error) {
 	user, err := s.GetUser(ctx, login)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
 	if err != nil {
-		return false, err
+		return "", false, err
+	}
+
+	ok, rehash, err := hash.VerifyPassword(password, user.PassHash, user.Key)
+	if err != nil || !ok {
+		return "", false, err
+	}
+
+	if rehash {
+		// Failed upgrade must not break login, old hash stays valid
+		newHash, err := hash.HashPassword(password)
+		if err != nil {
+			log.Warning(parent, err.Error())
+			return user.Login, true, nil
+		}
+		if err := s.UpdatePassword(ctx, user.Login, newHash, ""); err != nil {
+			log.Warning(parent, err.Error())
+			return user.Login, true, nil
+		}
+		log.Info(parent, fmt.Sprintf("Password hash upgraded for User: %s", user.Login))
+	}
+
+	return user.Login, true, nil
+}
+
+type passwordChange struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// ChangePassword sets new password after checking old one, all other sessions of user are revoked
+func ChangePassword(s storage.Storage, ac cache.AuthCache, hasher hasher.Hasher, policy verificator.CredentialsPolicy, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const parent = "handlers:ChangePassword"
+		log := logger.FromContext(r.Context(), log)
+
+		login, err := contextLogin(r)
+		if err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+
+		var change passwordChange
+		if err := decodeJSON(r, maxCredentialsBody, &change); err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+		if violations := policy.ValidatePassword(login, change.NewPassword); len(violations) > 0 {
+			writeError(w, r, parent, validationError(violations), log)
+			return
+		}
+
+		_, pass, err := validatePass(r.Context(), s, hasher, login, change.OldPassword, log)
+		if err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+		if !pass {
+			log.Info(parent, fmt.Sprintf("Wrong old password of User: %s", login))
+			writeError(w, r, parent, newError(http.StatusForbidden, "wrong_password", "Wrong old password"), log)
+			return
+		}
+
+		hash, err := hasher.HashPassword(change.NewPassword)
+		if err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+		if err := s.UpdatePassword(r.Context(), login, hash, ""); err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+		log.Info(parent, fmt.Sprintf("Password changed for User: %s", login))
+
+		// Sessions opened with old password are ended, current one is kept
+		var current string
+		if reqToken, err := r.Cookie("GOPHER_MARKET_AUTH"); err == nil {
+			current = cache.SessionID(reqToken.Value)
+		}
+		if err := ac.RevokeSessions(login, current); err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
+		// Signed tokens are revoked all together, so current session gets new one
+		if issuer, ok := ac.(cache.TokenIssuer); ok {
+			token, err := issuer.IssueToken(r.Context(), login)
+			if err != nil {
+				writeError(w, r, parent, err, log)
+				return
+			}
+			setAuthCookie(w, &http.Cookie{Name: "GOPHER_MARKET_AUTH", Value: token, Path: "/api", Expires: time.Now().Add(ac.GetLifetime())})
+		}
+
+		_, err = w.Write([]byte(`{"status": "success"}`))
+		if err != nil {
+			log.Error(parent, err.Error())
+		}
 	}
+}
+
+// DeleteUser removes account of current user and ends all its sessions
+func DeleteUser(s storage.Storage, ac cache.AuthCache, log logger.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const parent = "handlers:DeleteUser"
+		log := logger.FromContext(r.Context(), log)
+
+		login, err := contextLogin(r)
+		if err != nil {
+			writeError(w, r, parent, err, log)
+			return
+		}
 
-	passHash := hash.GetHash(password, user.Key)
+		if err := s.DeleteUser(r.Context(), login); err != nil {
+			// ErrOrdersInProgress is mapped to 409
+			writeError(w, r, parent, err, log)
+			return
+		}
+		log.Info(parent, fmt.Sprintf("Deleted User: %s", login))
+
+		// Signed tokens are revoked already, version is deleted together with user
+		if err := ac.RevokeSessions(login, ""); err != nil && !errors.Is(err, cache.ErrUnknownUser) {
+			writeError(w, r, parent, err, log)
+			return
+		}
+		dropAuthCookie(w)
 
-	if passHash != user.PassHash {
-		return false, nil
+		_, err = w.Write([]byte(`{"status": "success"}`))
+		if err != nil {
+			log.Error(parent, err.Error())
+		}
 	}
+}
 
-	return true, nil
+// requireCredentials checks login request has both login and password
+func requireCredentials(login string, password string) []verificator.Violation {
+	var violations []verificator.Violation
+	if login == "" {
+		violations = append(violations, verificator.Violation{Field: "login", Rule: "required", Message: "login is required"})
+	}
+	if password == "" {
+		violations = append(violations, verificator.Violation{Field: "password", Rule: "required", Message: "password is required"})
+	}
+	return violations
 }
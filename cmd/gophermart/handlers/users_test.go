@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"aprokhorov-diploma-1/internal/cache"
+	"aprokhorov-diploma-1/internal/logger"
+	"aprokhorov-diploma-1/internal/storage"
+	"aprokhorov-diploma-1/internal/throttle"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var authCaches = []struct {
+	name     string
+	newCache func(database *storage.Memory, log logger.Logger) cache.AuthCache
+}{
+	{"Memory AuthCache", nil},
+	{"Signed AuthCache", signedCache},
+}
+
+func TestChangePassword(t *testing.T) {
+	const newPassword = "Gopher-Mart-43"
+
+	for _, ac := range authCaches {
+		t.Run(ac.name, func(t *testing.T) {
+			ts := newTestServer(t, ac.newCache)
+			current := ts.register(t, "changer")
+			w := ts.login("changer", testPassword)
+			require.Equal(t, http.StatusOK, w.Code)
+			other := authCookie(w)
+
+			tests := []struct {
+				name     string
+				body     string
+				token    string
+				wantCode int
+			}{
+				{"Unauthorized", `{"old_password":"` + testPassword + `","new_password":"` + newPassword + `"}`, "", http.StatusUnauthorized},
+				{"Weak new password", `{"old_password":"` + testPassword + `","new_password":"short"}`, current, http.StatusBadRequest},
+				{"Wrong old password", `{"old_password":"Wrong-Pass-42","new_password":"` + newPassword + `"}`, current, http.StatusForbidden},
+				{"Success", `{"old_password":"` + testPassword + `","new_password":"` + newPassword + `"}`, current, http.StatusOK},
+			}
+			for _, tt := range tests {
+				w = ts.do(http.MethodPost, "/api/user/password", tt.body, tt.token)
+				assert.Equal(t, tt.wantCode, w.Code, tt.name)
+			}
+
+			// Current session is kept, with new token if tokens are signed
+			if token := authCookie(w); token != "" {
+				current = token
+			}
+			assert.Equal(t, http.StatusOK, ts.do(http.MethodGet, "/api/user/balance", "", current).Code)
+			assert.Equal(t, http.StatusUnauthorized, ts.do(http.MethodGet, "/api/user/balance", "", other).Code)
+
+			assert.Equal(t, http.StatusUnauthorized, ts.login("changer", testPassword).Code)
+			assert.Equal(t, http.StatusOK, ts.login("changer", newPassword).Code)
+		})
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+
+	for _, ac := range authCaches {
+		t.Run(ac.name, func(t *testing.T) {
+			ts := newTestServer(t, ac.newCache)
+			token := ts.register(t, "quitter")
+			require.NoError(t, ts.database.AddOrder(ctx, "quitter", "12345678903"))
+
+			assert.Equal(t, http.StatusUnauthorized, ts.do(http.MethodDelete, "/api/user", "", "").Code)
+
+			// Account stays while order is processed
+			w := ts.do(http.MethodDelete, "/api/user", "", token)
+			assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+			assert.Equal(t, http.StatusOK, ts.do(http.MethodGet, "/api/user/balance", "", token).Code)
+
+			require.NoError(t, ts.database.ApplyAccrual(ctx, "12345678903", storage.StatusProcessed, 0))
+			w = ts.do(http.MethodDelete, "/api/user", "", token)
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			cookie := findAuthCookie(w)
+			require.NotNil(t, cookie)
+			assert.Empty(t, cookie.Value)
+
+			assert.Equal(t, http.StatusUnauthorized, ts.do(http.MethodGet, "/api/user/balance", "", token).Code)
+			assert.Equal(t, http.StatusUnauthorized, ts.login("quitter", testPassword).Code)
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	allowed := throttle.DefaultPolicy().LoginFailures
+
+	t.Run("Sequential", func(t *testing.T) {
+		ts := newTestServer(t, nil)
+		ts.register(t, "victim")
+
+		// Success resets failures of login
+		for i := 0; i < allowed-1; i++ {
+			assert.Equal(t, http.StatusUnauthorized, ts.login("victim", "Wrong-Password-1").Code)
+		}
+		assert.Equal(t, http.StatusOK, ts.login("victim", testPassword).Code)
+
+		for i := 0; i < allowed; i++ {
+			assert.Equal(t, http.StatusUnauthorized, ts.login("victim", "Wrong-Password-1").Code)
+		}
+		w := ts.login("victim", "Wrong-Password-1")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "30", w.Header().Get("Retry-After"))
+
+		// Right password is not checked during lockout
+		w = ts.login("victim", testPassword)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Empty(t, authCookie(w))
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		ts := newTestServer(t, nil)
+		ts.register(t, "victim")
+
+		var (
+			wg    sync.WaitGroup
+			mutex sync.Mutex
+			codes = make(map[int]int)
+		)
+		for i := 0; i < 60; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				code := ts.login("victim", "Wrong-Password-1").Code
+				mutex.Lock()
+				codes[code]++
+				mutex.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		// Password is checked no more than allowed times, the rest is refused
+		assert.LessOrEqual(t, codes[http.StatusUnauthorized], allowed)
+		assert.Equal(t, 60, codes[http.StatusUnauthorized]+codes[http.StatusTooManyRequests], codes)
+	})
+}
+
+func TestLoginCaseInsensitive(t *testing.T) {
+	for _, ac := range authCaches {
+		t.Run(ac.name, func(t *testing.T) {
+			ts := newTestServer(t, ac.newCache)
+			ts.register(t, "Shopper")
+
+			w := ts.do(http.MethodPost, "/api/user/register", `{"login":"SHOPPER","password":"`+testPassword+`"}`, "")
+			assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+			// Session belongs to login as it has been registered
+			w = ts.login("shopper", testPassword)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			login, err := ts.cache.GetTokenUser(authCookie(w))
+			require.NoError(t, err)
+			assert.Equal(t, "Shopper", login)
+			assert.Equal(t, http.StatusOK, ts.do(http.MethodGet, "/api/user/balance", "", authCookie(w)).Code)
+		})
+	}
+}
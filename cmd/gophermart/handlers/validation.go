@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// maxCredentialsBody limits body of requests with login and password
+const maxCredentialsBody = 4 << 10
+
+// maxJSONBody limits body of other JSON requests
+const maxJSONBody = 64 << 10
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// decodeJSON reads at most limit bytes of body into v
+func decodeJSON(r *http.Request, limit int64, v any) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > limit {
+		return errBodyTooLarge
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return newError(http.StatusBadRequest, "malformed_json", err.Error())
+	}
+	return nil
+}
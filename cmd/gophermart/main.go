@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -16,44 +18,49 @@ import (
 	"aprokhorov-diploma-1/cmd/gophermart/handlers"
 	"aprokhorov-diploma-1/internal/cache"
 	"aprokhorov-diploma-1/internal/hasher"
+	"aprokhorov-diploma-1/internal/health"
+	"aprokhorov-diploma-1/internal/lifecycle"
 	"aprokhorov-diploma-1/internal/logger"
+	"aprokhorov-diploma-1/internal/metrics"
 	"aprokhorov-diploma-1/internal/storage"
+	"aprokhorov-diploma-1/internal/throttle"
 	"aprokhorov-diploma-1/internal/verificator"
 
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
 )
 
+const (
+	// Limit of every dependency check in readiness probe
+	healthCheckTimeout = 2 * time.Second
+	// Accrual cron is stale if it did not tick for 10 intervals, but not less than this
+	minReadyTickAge = 30 * time.Second
+)
+
 func main() {
-	//Init Config
-	config := config.NewServerConfig()
-
-	// Init flags
-	flag.StringVar(&config.Server, "a", "127.0.0.1:8080", "Server ip:port")
-	flag.StringVar(&config.Database, "d", "", "Database ip:port")
-	flag.StringVar(&config.AccrualService, "r", "http://127.0.0.1:8081", "AccrualService ip:port")
-	flag.StringVar(&config.AccrualFrequency, "rf", "50us", "AccrualService Frequency, default:1s")
-	flag.StringVar(&config.DBName, "dn", "", "Database Name")
-	flag.StringVar(&config.LogLevel, "l", "debug", "Log Level, default:debug")
-	flag.StringVar(&config.AuthCacheTimeout, "at", "300s", "Auth Cache Timeout, default:300s")
-	flag.StringVar(&config.AuthCacheHouseKeeperTime, "ah", "1h", "Auth Cache HouseKeeper Interval, default:1h")
-	flag.Parse()
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
+	// Init Config: defaults < config file < env < flags
+	config, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	//Init Logger
 	var log logger.Logger
-	var err error
 
 	log, err = logger.NewZeroLogger(config.LogLevel)
 	if err != nil {
 		panic(err)
 	}
 
-	// Init Config from Env
-	err = config.EnvInit()
-	if err != nil {
-		log.Error("main", "Can't get enviroment")
-	}
-
 	log.Info("main", "Start GopherMart Today!")
 	log.Info("main", fmt.Sprint(config))
 
@@ -61,42 +68,149 @@ func main() {
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	// Init context
-	ctx := context.Background()
+	// Init Lifecycle, root context is cancelled on shutdown
+	lifecycle := lifecycle.New(log)
+	ctx := lifecycle.Context()
+
+	// Init Metrics
+	serviceMetrics := metrics.New()
 
 	// Init Database
-	database, err := storage.NewPostgresClient(ctx, config.Database, config.DBName)
+	database, err := storage.New(ctx, config.Database, config.DBName)
 	if err != nil {
 		log.Fatal("main", err.Error())
 	}
-	defer database.GracefulShutdown()
+	lifecycle.OnClose("database", database.GracefulShutdown)
+	if postgres, ok := database.(*storage.Postgres); ok {
+		postgres.Observer = serviceMetrics
+	}
 
-	// Init Hasher
-	mainHasher := hasher.NewHMAC()
+	// Reconcile Balances with Ledger, mismatches found on last run are exposed by metrics and readiness
+	ledgerReconcileTicker := time.NewTicker(config.LedgerReconcileTime)
+	var ledgerMismatches int64
 
-	// Init AuthCache
-	authCacheTimeout, err := time.ParseDuration(config.AuthCacheTimeout)
+	lifecycle.Go("ledger reconcile", func(ctx context.Context) {
+		defer ledgerReconcileTicker.Stop()
+		for {
+			mismatches, err := database.ReconcileBalances(ctx)
+			if err != nil {
+				log.Error("Ledger:Reconcile", err.Error())
+			} else {
+				atomic.StoreInt64(&ledgerMismatches, int64(len(mismatches)))
+				serviceMetrics.ObserveReconcile(len(mismatches))
+			}
+			for _, mismatch := range mismatches {
+				log.Warning("Ledger:Reconcile", fmt.Sprintf("Balance disagrees with Ledger, %v", mismatch))
+			}
+			select {
+			case <-ledgerReconcileTicker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	// Init Hasher
+	mainHasher, err := hasher.NewHMACWithPassword(config.PasswordHash)
 	if err != nil {
 		log.Fatal("main", err.Error())
 	}
-	authCache := cache.NewMemCache(authCacheTimeout, log)
 
-	authCacheHousekeeper, err := time.ParseDuration(config.AuthCacheHouseKeeperTime)
-	if err != nil {
-		log.Fatal("main", err.Error())
+	// Init AuthCache
+	authCacheTimeout := config.AuthCacheTimeout
+	var authCache cache.AuthCache
+	switch config.AuthCache {
+	case "memory":
+		memCache := cache.NewMemCache(authCacheTimeout, log)
+		err = serviceMetrics.RegisterGauge("auth_cache", "sessions", "Sessions stored in memory Auth Cache.", func() float64 {
+			return float64(memCache.Len())
+		})
+		if err != nil {
+			log.Fatal("main", err.Error())
+		}
+		authCache = memCache
+	case "postgres":
+		postgres, ok := database.(*storage.Postgres)
+		if !ok {
+			log.Fatal("main", "Auth Cache in postgres requires postgres Database")
+		}
+		pgCache, err := cache.NewPGCache(ctx, postgres.DB, authCacheTimeout, log)
+		if err != nil {
+			log.Fatal("main", err.Error())
+		}
+		lifecycle.OnClose("auth cache", pgCache.Close)
+		authCache = pgCache
+	case "signed":
+		signingKey, err := cache.ParseSigningKey(config.AuthSigningKey)
+		if err != nil {
+			log.Fatal("main", err.Error())
+		}
+		var previousKey cache.SigningKey
+		if config.AuthSigningPreviousKey != "" {
+			previousKey, err = cache.ParseSigningKey(config.AuthSigningPreviousKey)
+			if err != nil {
+				log.Fatal("main", err.Error())
+			}
+		}
+		// Token versions are kept with users, so tokens can be revoked
+		authCache = cache.NewSignedCache(mainHasher, signingKey, previousKey, config.AuthSigningGrace, authCacheTimeout, config.AuthSessionMaxAge, storage.NewTokenVersions(database), log)
+	default:
+		log.Fatal("main", fmt.Sprintf("Unknown Auth Cache storage: %s", config.AuthCache))
 	}
-	authHousekeeperTicker := time.NewTicker(authCacheHousekeeper)
 
-	go func() {
+	// Init Login Throttler, counters are shared via Postgres together with sessions
+	throttlePolicy := throttle.DefaultPolicy()
+	throttlePolicy.LoginFailures = config.LoginMaxFailures
+	throttlePolicy.IPFailures = config.LoginMaxIPFailures
+	throttlePolicy.Lockout = config.LoginLockout
+	throttlePolicy.MaxLockout = config.LoginMaxLockout
+	var throttleStore throttle.Store = throttle.NewMemStore()
+	if config.AuthCache == "postgres" {
+		pgStore, err := throttle.NewPGStore(ctx, database.(*storage.Postgres).DB)
+		if err != nil {
+			log.Fatal("main", err.Error())
+		}
+		lifecycle.OnClose("throttle store", pgStore.Close)
+		throttleStore = pgStore
+	}
+	throttler := throttle.New(throttleStore, throttlePolicy, log)
+
+	authHousekeeperTicker := time.NewTicker(config.AuthCacheHouseKeeperTime)
+
+	lifecycle.Go("housekeeper", func(ctx context.Context) {
+		defer authHousekeeperTicker.Stop()
 		for {
-			<-authHousekeeperTicker.C
+			select {
+			case <-authHousekeeperTicker.C:
+			case <-ctx.Done():
+				return
+			}
 			err := authCache.HouseKeeper()
 			if err != nil {
-				log.Error("MemCache:HouseKeeper", err.Error())
+				log.Error("AuthCache:HouseKeeper", err.Error())
+			}
+			err = throttler.HouseKeeper(ctx)
+			if err != nil {
+				log.Error("Throttle:HouseKeeper", err.Error())
 			}
-			// TODO: add closing channel
 		}
-	}()
+	})
+
+	// Init Credentials Policy
+	credentialsPolicy := verificator.DefaultCredentialsPolicy()
+	credentialsPolicy.PasswordMinLength = config.PasswordMinLength
+	credentialsPolicy.PasswordClasses = config.PasswordClasses
+	if config.PasswordDenyList != "" {
+		denyList, err := os.Open(config.PasswordDenyList)
+		if err != nil {
+			log.Fatal("main", err.Error())
+		}
+		err = credentialsPolicy.AddDenyList(denyList)
+		denyList.Close()
+		if err != nil {
+			log.Fatal("main", err.Error())
+		}
+	}
 
 	// Init Verificator
 	verificator, err := verificator.NewLuhn()
@@ -104,7 +218,32 @@ func main() {
 		log.Fatal("main", err.Error())
 	}
 
+	// Accrual Service Operations
+	frequency := config.AccrualFrequency
+	accrualService := accrual.NewAccrualService(config.AccrualService.String(), frequency, log)
+	accrualService.Observer = serviceMetrics
+
+	// Init Health Checks, accrual service outage only delays accruals, so it is optional
+	cronHeartbeat := health.NewHeartbeat()
+	readyTickAge := 10 * frequency
+	if readyTickAge < minReadyTickAge {
+		readyTickAge = minReadyTickAge
+	}
+	healthChecker := health.New(healthCheckTimeout, log)
+	healthChecker.Add("database", database.Ping)
+	healthChecker.Add("accrual_cron", cronHeartbeat.Check(readyTickAge))
+	healthChecker.AddOptional("accrual", accrualService.Ping)
+	// Drifted balance is a bug to look into, not a reason to stop serving
+	healthChecker.AddOptional("ledger", func(ctx context.Context) error {
+		if mismatches := atomic.LoadInt64(&ledgerMismatches); mismatches > 0 {
+			return fmt.Errorf("%d balances disagree with ledger", mismatches)
+		}
+		return nil
+	})
+
 	/*
+		GET /healthz — процесс жив;
+		GET /readyz — готовность принимать запросы, статус зависимостей;
 		POST /api/user/register — регистрация пользователя;
 		POST /api/user/login — аутентификация пользователя;
 		POST /api/user/orders — загрузка пользователем номера заказа для расчёта;
@@ -112,16 +251,29 @@ func main() {
 		GET /api/user/balance — получение текущего баланса счёта баллов лояльности пользователя;
 		POST /api/user/balance/withdraw — запрос на списание баллов с накопительного счёта в счёт оплаты нового заказа;
 		GET /api/user/balance/withdrawals -- ошибка в ТЗ, правильный /api/user/withdrawals
+		POST /api/user/password — смена пароля пользователя;
+		DELETE /api/user — удаление учётной записи пользователя;
+		POST /api/user/logout — завершение текущей сессии;
+		GET /api/user/sessions — список активных сессий пользователя;
+		DELETE /api/user/sessions — завершение всех сессий пользователя;
+		DELETE /api/user/sessions/{id} — завершение сессии по id;
 	*/
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)      // Access Log
-	r.Use(middleware.Compress(5)) // Support for gzip
+	r.Use(handlers.RequestID(log))   // Request ID for logs and error responses
+	r.Use(serviceMetrics.Middleware) // Request metrics by route pattern
+	r.Use(middleware.Logger)         // Access Log
+	r.Use(middleware.Compress(5))    // Support for gzip
+
+	r.Get("/healthz", healthChecker.Liveness())
+	r.Get("/readyz", healthChecker.Readiness())
 
 	r.Route("/api/user", func(r chi.Router) {
 		r.Route("/", func(r chi.Router) {
 			r.Use(handlers.CheckHeaders(log)) // Check content-type == app/json for post.request
-			r.Post("/register", handlers.Authorize(true, database, authCache, mainHasher, log))
-			r.Post("/login", handlers.Authorize(false, database, authCache, mainHasher, log))
+			r.Post("/register", handlers.Authorize(true, database, authCache, mainHasher, throttler, credentialsPolicy, log))
+			r.Post("/login", handlers.Authorize(false, database, authCache, mainHasher, throttler, credentialsPolicy, log))
+			r.With(handlers.AuthMiddleware(authCache, log)).Post("/password", handlers.ChangePassword(database, authCache, mainHasher, credentialsPolicy, log))
+			r.With(handlers.AuthMiddleware(authCache, log)).Delete("/", handlers.DeleteUser(database, authCache, log))
 		})
 
 		r.Route("/orders", func(r chi.Router) {
@@ -134,13 +286,25 @@ func main() {
 			r.Use(handlers.CheckHeaders(log))              // Check content-type == app/json for post.request
 			r.Use(handlers.AuthMiddleware(authCache, log)) // Check Authorization Token
 			r.Get("/", handlers.GetBalance(database, log))
-			r.Post("/withdraw", handlers.AddWithdraw(database, log))
+			r.Post("/withdraw", handlers.AddWithdraw(database, verificator, log))
 		})
 		r.Route("/withdrawals", func(r chi.Router) {
 			r.Use(handlers.AuthMiddleware(authCache, log)) // Check Authorization Token
 			r.Get("/", handlers.GetWithdrawals(database, log))
 		})
 
+		r.Route("/logout", func(r chi.Router) {
+			r.Use(handlers.AuthMiddleware(authCache, log)) // Check Authorization Token
+			r.Post("/", handlers.Logout(authCache, log))
+		})
+
+		r.Route("/sessions", func(r chi.Router) {
+			r.Use(handlers.AuthMiddleware(authCache, log)) // Check Authorization Token
+			r.Get("/", handlers.GetSessions(authCache, log))
+			r.Delete("/", handlers.DeleteSessions(authCache, log)) // Log out everywhere
+			r.Delete("/{id}", handlers.DeleteSession(authCache, log))
+		})
+
 	})
 
 	// Init Server
@@ -149,24 +313,64 @@ func main() {
 		Handler: r,
 	}
 
+	// Readiness is dropped first and server keeps serving for drain delay,
+	// so balancer notices it and stops sending requests before server drains them
+	lifecycle.OnShutdown("readiness", func(ctx context.Context) error {
+		healthChecker.Shutdown()
+		select {
+		case <-time.After(config.ShutdownDrainDelay):
+		case <-ctx.Done():
+		}
+		return nil
+	})
+	lifecycle.OnShutdown("server", server.Shutdown)
+
 	go func() {
-		log.Fatal("main", server.ListenAndServe().Error())
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("main", err.Error())
+		}
 	}()
 
 	log.Info("main", "Server Started")
 
-	// Accrual Service Operations
-	frequency, err := time.ParseDuration(config.AccrualFrequency)
-	if err != nil {
-		log.Error("main", err.Error())
+	// Init Admin Server, metrics are kept off public listener
+	if config.AdminAddress != "" {
+		adminRouter := chi.NewRouter()
+		adminRouter.Handle("/metrics", serviceMetrics.Handler())
+		adminServer := &http.Server{
+			Addr:    config.AdminAddress,
+			Handler: adminRouter,
+		}
+
+		lifecycle.OnShutdown("admin server", adminServer.Shutdown)
+
+		go func() {
+			err := adminServer.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal("main", err.Error())
+			}
+		}()
+
+		log.Info("main", "Admin Server Started")
 	}
-	accrualService := accrual.NewAccrualService(config.AccrualService, frequency)
 
 	ticketAccrual := time.NewTicker(frequency)
 
-	go cron.StartOrderCheckProcess(ctx, ticketAccrual.C, accrualService, database, log)
+	registerTimeout := time.Duration(config.AccrualRegisterDays) * 24 * time.Hour
+
+	lifecycle.Go("accrual cron", func(ctx context.Context) {
+		defer ticketAccrual.Stop()
+		cron.StartOrderCheckProcess(ctx, ticketAccrual.C, accrualService, config.AccrualWorkers, registerTimeout, database, serviceMetrics, cronHeartbeat, log)
+	})
 
 	<-done
 	log.Info("main", "Shutdown")
 
+	// Server drains requests, cron finishes orders taken, then Postgres is closed
+	err = lifecycle.Shutdown(config.ShutdownTimeout)
+	if err != nil {
+		log.Error("main", err.Error())
+	}
+	log.Info("main", "Stopped")
 }
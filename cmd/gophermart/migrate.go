@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"aprokhorov-diploma-1/cmd/gophermart/config"
+	"aprokhorov-diploma-1/internal/storage"
+)
+
+const migrateUsage = `Usage: gophermart migrate [-c file] [-d uri] [-dn name] <command>
+
+Commands:
+  up        apply all pending migrations
+  check     report data pending migrations would fail on, without applying them
+  down [N]  roll back last N applied migrations, default:1
+  status    list migrations and time they have been applied
+`
+
+// runMigrate handles "gophermart migrate" subcommand and returns process exit code
+func runMigrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), migrateUsage)
+		flags.PrintDefaults()
+	}
+	// Same sources as server, but only database settings are used
+	var configErrs config.Errors
+	config, err := config.Load(flags, args)
+	if errors.As(err, &configErrs) {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err != nil {
+		// Flag errors are printed by flags already
+		return 2
+	}
+	if config.Database == "" {
+		fmt.Fprintln(os.Stderr, "database_uri: is not set")
+		return 2
+	}
+	if strings.HasPrefix(config.Database, storage.MemoryDSN) {
+		fmt.Fprintln(os.Stderr, "database_uri: migrations apply only to Postgres, not "+storage.MemoryDSN)
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	db, err := storage.OpenPostgres(config.Database, config.DBName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	switch flags.Arg(0) {
+	case "up":
+		err = storage.Migrate(ctx, db)
+	case "check":
+		err = storage.CheckMigrations(ctx, db)
+		if err == nil {
+			fmt.Println("Pending migrations can be applied")
+		}
+	case "down":
+		steps := 1
+		if flags.NArg() > 1 {
+			steps, err = strconv.Atoi(flags.Arg(1))
+			if err != nil || steps < 1 {
+				fmt.Fprintf(os.Stderr, "bad number of steps: %s\n", flags.Arg(1))
+				return 2
+			}
+		}
+		err = storage.MigrateDown(ctx, db, steps)
+	case "status":
+		var states []storage.MigrationState
+		states, err = storage.MigrationStatus(ctx, db)
+		for _, state := range states {
+			applied := "pending"
+			if !state.AppliedAt.IsZero() {
+				applied = state.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", state.Version, state.Name, applied)
+		}
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
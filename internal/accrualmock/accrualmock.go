@@ -0,0 +1,334 @@
+package accrualmock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"aprokhorov-diploma-1/internal/logger"
+	"aprokhorov-diploma-1/internal/money"
+	"aprokhorov-diploma-1/internal/verificator"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const parent string = "AccrualMock"
+
+// Statuses of accrual calculation, INVALID and PROCESSED are final
+const (
+	StatusRegistered = "REGISTERED"
+	StatusProcessing = "PROCESSING"
+	StatusInvalid    = "INVALID"
+	StatusProcessed  = "PROCESSED"
+)
+
+// Reward types of Rule
+const (
+	RewardPercent = "%"
+	RewardPoints  = "pt"
+)
+
+// Quota window of the real accrual system, it is a part of 429 respond body
+const quotaWindow = time.Minute
+
+var (
+	ErrOrderExists  = errors.New("order is already registered")
+	ErrBadOrder     = errors.New("bad order number")
+	ErrRuleExists   = errors.New("rule with same match is already registered")
+	ErrBadRule      = errors.New("bad rule")
+	errUnknownOrder = errors.New("order is not registered")
+)
+
+// Good is a position of order, it is rewarded by first Rule matching its description
+type Good struct {
+	Description string      `json:"description"`
+	Price       money.Money `json:"price"`
+}
+
+// Rule rewards goods which description contains Match, case insensitive.
+// Reward is a percent of price or fixed points per good depending on RewardType.
+type Rule struct {
+	Match      string  `json:"match"`
+	Reward     float64 `json:"reward"`
+	RewardType string  `json:"reward_type"`
+}
+
+func (r Rule) validate() error {
+	if r.Match == "" || r.Reward < 0 || (r.RewardType != RewardPercent && r.RewardType != RewardPoints) {
+		return fmt.Errorf("%w: %+v", ErrBadRule, r)
+	}
+	return nil
+}
+
+// Options of mock behaviour, zero value is a fast mock without quota
+type Options struct {
+	// Steps is number of polls answered with every intermediate status (REGISTERED, PROCESSING)
+	Steps int
+	// Quota is requests per minute allowed, 0 is unlimited
+	Quota int
+	// Latency is added to every respond
+	Latency time.Duration
+	// AutoRegister registers unknown order on first poll instead of answering 204,
+	// order gets DefaultGoods and is INVALID if number fails Luhn check
+	AutoRegister bool
+	DefaultGoods []Good
+	Rules        []Rule
+}
+
+type order struct {
+	goods   []Good
+	invalid bool
+	polls   int
+}
+
+// Order is a respond of GET /api/orders/{number}, Accrual is omitted if there is none
+type Order struct {
+	Order   string       `json:"order"`
+	Status  string       `json:"status"`
+	Accrual *money.Money `json:"accrual,omitempty"`
+}
+
+// Server is an in-memory accrual system, it is a http.Handler to be used with httptest.
+// Every poll of order moves it forward: Steps polls REGISTERED, Steps polls PROCESSING,
+// then PROCESSED with accrual by rules, or INVALID if order has no goods.
+type Server struct {
+	mutex       *sync.Mutex
+	options     Options
+	rules       []Rule
+	orders      map[string]*order
+	luhn        verificator.Verificator
+	windowStart time.Time
+	requests    int
+	router      chi.Router
+	log         logger.Logger
+	now         func() time.Time
+}
+
+func New(options Options, log logger.Logger) (*Server, error) {
+	luhn, err := verificator.NewLuhn()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		mutex:   &sync.Mutex{},
+		options: options,
+		orders:  make(map[string]*order),
+		luhn:    luhn,
+		log:     log,
+		now:     time.Now,
+	}
+	for _, rule := range options.Rules {
+		if err := s.AddRule(rule); err != nil {
+			return nil, err
+		}
+	}
+
+	r := chi.NewRouter()
+	r.Use(s.latency)
+	// Quota limits polls only, registration is a back office API
+	r.With(s.quota).Get("/api/orders/{number}", s.getOrder)
+	r.Post("/api/orders", s.postOrder)
+	r.Post("/api/goods", s.postRule)
+	s.router = r
+
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// RegisterOrder makes order known to accrual system, order without goods becomes INVALID
+func (s *Server) RegisterOrder(number string, goods ...Good) error {
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 || !s.luhn.Valid(n) {
+		return fmt.Errorf("%w: %s", ErrBadOrder, number)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.orders[number]; ok {
+		return fmt.Errorf("%w: %s", ErrOrderExists, number)
+	}
+	s.orders[number] = &order{goods: goods, invalid: len(goods) == 0}
+	return nil
+}
+
+// AddRule adds reward rule, it is applied to orders processed later
+func (s *Server) AddRule(rule Rule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, r := range s.rules {
+		if strings.EqualFold(r.Match, rule.Match) {
+			return fmt.Errorf("%w: %s", ErrRuleExists, rule.Match)
+		}
+	}
+	s.rules = append(s.rules, rule)
+	return nil
+}
+
+// poll moves order one step forward and returns its state
+func (s *Server) poll(number string) (Order, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	o, ok := s.orders[number]
+	if !ok {
+		if !s.options.AutoRegister {
+			return Order{}, errUnknownOrder
+		}
+		n, err := strconv.ParseInt(number, 10, 64)
+		o = &order{goods: s.options.DefaultGoods, invalid: err != nil || !s.luhn.Valid(n)}
+		s.orders[number] = o
+	}
+
+	steps := s.options.Steps
+	if steps < 0 {
+		steps = 0
+	}
+	o.polls++
+	switch {
+	case o.polls <= steps:
+		return Order{Order: number, Status: StatusRegistered}, nil
+	case o.polls <= 2*steps:
+		return Order{Order: number, Status: StatusProcessing}, nil
+	case o.invalid:
+		return Order{Order: number, Status: StatusInvalid}, nil
+	}
+
+	result := Order{Order: number, Status: StatusProcessed}
+	if accrual := s.accrual(o.goods); accrual > 0 {
+		result.Accrual = &accrual
+	}
+	return result, nil
+}
+
+// accrual sums rewards of goods, caller holds the mutex
+func (s *Server) accrual(goods []Good) money.Money {
+	var total money.Money
+	for _, good := range goods {
+		for _, rule := range s.rules {
+			if !strings.Contains(strings.ToLower(good.Description), strings.ToLower(rule.Match)) {
+				continue
+			}
+			if rule.RewardType == RewardPercent {
+				total += money.Money(math.Round(float64(good.Price) * rule.Reward / 100))
+			} else {
+				total += money.FromFloat(rule.Reward)
+			}
+			break
+		}
+	}
+	return total
+}
+
+// latency delays respond, request is dropped if client is gone
+func (s *Server) latency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.options.Latency > 0 {
+			timer := time.NewTimer(s.options.Latency)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// quota answers 429 with Retry-After till end of current minute when quota is exceeded
+func (s *Server) quota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.options.Quota <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s.mutex.Lock()
+		now := s.now()
+		if now.Sub(s.windowStart) >= quotaWindow {
+			s.windowStart = now
+			s.requests = 0
+		}
+		s.requests++
+		exceeded := s.requests > s.options.Quota
+		retryAfter := s.windowStart.Add(quotaWindow).Sub(now)
+		s.mutex.Unlock()
+
+		if exceeded {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintf(w, "No more than %d requests per minute allowed", s.options.Quota)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, r *http.Request) {
+	number := chi.URLParam(r, "number")
+	result, err := s.poll(number)
+	if errors.Is(err, errUnknownOrder) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	s.log.Debug(parent, fmt.Sprintf("order:%s status:%s", result.Order, result.Status))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) postOrder(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Order string `json:"order"`
+		Goods []Good `json:"goods"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := s.RegisterOrder(request.Order, request.Goods...)
+	switch {
+	case errors.Is(err, ErrOrderExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		s.log.Debug(parent, "registered order:"+request.Order)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (s *Server) postRule(w http.ResponseWriter, r *http.Request) {
+	var rule Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := s.AddRule(rule)
+	switch {
+	case errors.Is(err, ErrRuleExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		s.log.Debug(parent, "registered rule:"+rule.Match)
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,158 @@
+package accrualmock
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aprokhorov-diploma-1/internal/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newServer(t *testing.T, options Options) *Server {
+	log, _ := logger.NewZeroLogger("error")
+	s, err := New(options, log)
+	require.NoError(t, err)
+	return s
+}
+
+func get(s *Server, number string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/orders/"+number, nil))
+	return w
+}
+
+func TestServer_Progression(t *testing.T) {
+	tests := []struct {
+		name       string
+		number     string
+		goods      []Good
+		autoReg    bool
+		wantCodes  []int
+		wantBodies []string
+	}{
+		{
+			name:      "Unknown order",
+			number:    "371449635398431",
+			wantCodes: []int{http.StatusNoContent, http.StatusNoContent},
+		},
+		{
+			name:   "Rewarded goods",
+			number: "12345678903",
+			goods: []Good{
+				{Description: "Чайник BORK", Price: 700000},
+				{Description: "Стиральная машинка LG", Price: 4200000},
+				{Description: "Утюг Philips", Price: 550050},
+			},
+			wantCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK},
+			wantBodies: []string{
+				`{"order":"12345678903","status":"REGISTERED"}`,
+				`{"order":"12345678903","status":"PROCESSING"}`,
+				`{"order":"12345678903","status":"PROCESSED","accrual":700.01}`,
+				`{"order":"12345678903","status":"PROCESSED","accrual":700.01}`,
+			},
+		},
+		{
+			name:      "Order without reward",
+			number:    "79927398713",
+			goods:     []Good{{Description: "Пылесос Samsung", Price: 100}},
+			wantCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+			wantBodies: []string{
+				`{"order":"79927398713","status":"REGISTERED"}`,
+				`{"order":"79927398713","status":"PROCESSING"}`,
+				`{"order":"79927398713","status":"PROCESSED"}`,
+			},
+		},
+		{
+			name:      "Auto registered bad number",
+			number:    "12345678904",
+			autoReg:   true,
+			wantCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+			wantBodies: []string{
+				`{"order":"12345678904","status":"REGISTERED"}`,
+				`{"order":"12345678904","status":"PROCESSING"}`,
+				`{"order":"12345678904","status":"INVALID"}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t, Options{
+				Steps:        1,
+				AutoRegister: tt.autoReg,
+				Rules: []Rule{
+					{Match: "Bork", Reward: 10, RewardType: RewardPercent},
+					{Match: "Philips", Reward: 0.01, RewardType: RewardPoints},
+				},
+			})
+			if tt.goods != nil {
+				require.NoError(t, s.RegisterOrder(tt.number, tt.goods...))
+				assert.ErrorIs(t, s.RegisterOrder(tt.number), ErrOrderExists)
+			}
+
+			for i, wantCode := range tt.wantCodes {
+				w := get(s, tt.number)
+				assert.Equal(t, wantCode, w.Code)
+				if tt.wantBodies != nil {
+					assert.JSONEq(t, tt.wantBodies[i], w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestServer_Quota(t *testing.T) {
+	s := newServer(t, Options{Quota: 2, AutoRegister: true})
+	now := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	assert.Equal(t, http.StatusOK, get(s, "371449635398431").Code)
+	now = now.Add(15 * time.Second)
+	assert.Equal(t, http.StatusOK, get(s, "371449635398431").Code)
+
+	now = now.Add(500 * time.Millisecond)
+	w := get(s, "371449635398431")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "45", w.Header().Get("Retry-After"))
+	assert.Equal(t, "No more than 2 requests per minute allowed", w.Body.String())
+
+	// Registration is not limited
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(`{"order":"12345678903","goods":[]}`)))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	now = now.Add(45 * time.Second)
+	assert.Equal(t, http.StatusOK, get(s, "12345678903").Code)
+}
+
+func TestServer_Register(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{"Order", "/api/orders", `{"order":"12345678903","goods":[{"description":"Чайник Bork","price":7000}]}`, http.StatusAccepted},
+		{"Duplicate order", "/api/orders", `{"order":"12345678903"}`, http.StatusConflict},
+		{"Bad order number", "/api/orders", `{"order":"12345678904"}`, http.StatusBadRequest},
+		{"Bad json", "/api/orders", `{"order":`, http.StatusBadRequest},
+		{"Rule", "/api/goods", `{"match":"Bork","reward":10,"reward_type":"%"}`, http.StatusOK},
+		{"Duplicate rule", "/api/goods", `{"match":"BORK","reward":5,"reward_type":"pt"}`, http.StatusConflict},
+		{"Bad reward type", "/api/goods", `{"match":"LG","reward":5,"reward_type":"usd"}`, http.StatusBadRequest},
+	}
+	s := newServer(t, Options{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+
+	w := get(s, "12345678903")
+	assert.JSONEq(t, `{"order":"12345678903","status":"PROCESSED","accrual":700}`, w.Body.String())
+}
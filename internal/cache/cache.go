@@ -1,16 +1,82 @@
 package cache
 
-import "time"
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrNotSupported    = errors.New("not supported by auth cache")
+	ErrUnknownUser     = errors.New("unknown user")
+)
+
+// SessionMeta describes client session was opened from
+type SessionMeta struct {
+	UserAgent string
+	IP        string
+}
 
 type AuthData struct {
 	Login      string
-	Token      string
+	TokenHash  string
+	CreatedAt  time.Time
 	LastActive time.Time
+	SessionMeta
+}
+
+// Session is a view of active session shown to its owner, ID is hash of token
+type Session struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastActive time.Time `json:"last_active"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
 }
 
 type AuthCache interface {
-	StoreToken(login string, token string) error
+	StoreToken(login string, token string, meta SessionMeta) error
+	// RefreshToken prolongs existing session, revoked session is not restored
+	RefreshToken(token string) error
 	GetTokenUser(token string) (string, error)
+	RevokeToken(token string) error
+	GetSessions(login string) ([]Session, error)
+	RevokeSession(login string, id string) error
+	// RevokeSessions ends all sessions of login except one with id except
+	RevokeSessions(login string, except string) error
 	HouseKeeper() error
 	GetLifetime() time.Duration
 }
+
+// TokenIssuer is implemented by stateless AuthCache which issues tokens itself
+// instead of storing random ones
+type TokenIssuer interface {
+	IssueToken(ctx context.Context, login string) (string, error)
+	// ReissueToken verifies token and returns its login and token of the same session with prolonged expiry
+	ReissueToken(ctx context.Context, token string) (string, string, error)
+}
+
+// SessionID returns id of session opened with token
+func SessionID(token string) string {
+	return hashToken(token)
+}
+
+// hashToken returns hash of token to be stored instead of token itself
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (ad AuthData) session() Session {
+	return Session{
+		ID:         ad.TokenHash,
+		CreatedAt:  ad.CreatedAt,
+		LastActive: ad.LastActive,
+		UserAgent:  ad.UserAgent,
+		IP:         ad.IP,
+	}
+}
@@ -3,6 +3,7 @@ package cache
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -11,8 +12,11 @@ import (
 
 const parent string = "MemCache"
 
+// MemCache keeps sessions in process memory, indexed by hash of token
+// so a memory dump does not leak live tokens
 type MemCache struct {
 	DB       map[string]AuthData
+	byLogin  map[string]map[string]struct{}
 	log      logger.Logger
 	mutex    *sync.RWMutex
 	Lifetime time.Duration
@@ -22,63 +26,148 @@ func NewMemCache(timeout time.Duration, log logger.Logger) *MemCache {
 	db := make(map[string]AuthData)
 	return &MemCache{
 		DB:       db,
+		byLogin:  make(map[string]map[string]struct{}),
 		log:      log,
 		mutex:    &sync.RWMutex{},
 		Lifetime: timeout,
 	}
 }
 
+// Len returns number of stored sessions
+func (mc *MemCache) Len() int {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+	return len(mc.DB)
+}
+
 func (mc *MemCache) GetLifetime() time.Duration {
 	return mc.Lifetime
 }
 
-func (mc *MemCache) StoreToken(login string, token string) error {
+func (mc *MemCache) StoreToken(login string, token string, meta SessionMeta) error {
+	now := time.Now()
 	ad := AuthData{
-		Login:      login,
-		Token:      token,
-		LastActive: time.Now(),
+		Login:       login,
+		TokenHash:   hashToken(token),
+		CreatedAt:   now,
+		LastActive:  now,
+		SessionMeta: meta,
 	}
 
 	mc.mutex.Lock()
 	defer mc.mutex.Unlock()
-	mc.DB[ad.Token] = ad
+	mc.DB[ad.TokenHash] = ad
+	if mc.byLogin[login] == nil {
+		mc.byLogin[login] = make(map[string]struct{})
+	}
+	mc.byLogin[login][ad.TokenHash] = struct{}{}
 	mc.log.Debug(parent, fmt.Sprintf("Store Token for User: %s", ad.Login))
 	return nil
 }
 
-func (mc *MemCache) GetTokenUser(token string) (string, error) {
-	ad := AuthData{
-		Login: "",
-		Token: token,
+func (mc *MemCache) RefreshToken(token string) error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	hash := hashToken(token)
+	ad, exist := mc.DB[hash]
+	if !exist {
+		return nil
 	}
+	ad.LastActive = time.Now()
+	mc.DB[hash] = ad
+	return nil
+}
 
-	adLocal, exist := mc.DB[ad.Token]
+func (mc *MemCache) GetTokenUser(token string) (string, error) {
+	mc.mutex.RLock()
+	adLocal, exist := mc.DB[hashToken(token)]
+	mc.mutex.RUnlock()
 	if !exist {
-		mc.log.Debug(parent, fmt.Sprintf("Verify() No User for Token: %s", ad.Token))
-		return ad.Login, errors.New("please, log in")
+		mc.log.Debug(parent, "Verify() No User for Token")
+		return "", errors.New("please, log in")
 	}
 
 	if time.Since(adLocal.LastActive) > mc.Lifetime {
 		mc.log.Debug(parent, fmt.Sprintf("Verify() Token Expired for User: %s", adLocal.Login))
-		return ad.Login, errors.New("expired. please, log in")
+		return "", errors.New("expired. please, log in")
 	}
-	if ad.Token == adLocal.Token {
-		mc.log.Debug(parent, fmt.Sprintf("Verify() Successfully find Token for User: %s", adLocal.Login))
-		return adLocal.Login, nil
+
+	mc.log.Debug(parent, fmt.Sprintf("Verify() Successfully find Token for User: %s", adLocal.Login))
+	return adLocal.Login, nil
+}
+
+func (mc *MemCache) RevokeToken(token string) error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	hash := hashToken(token)
+	if ad, exist := mc.DB[hash]; exist {
+		mc.delete(ad)
+		mc.log.Debug(parent, fmt.Sprintf("Revoke Token of User: %s", ad.Login))
 	}
-	mc.log.Debug(parent, fmt.Sprintf("Verify() Unexpected condition Token: %s", ad.Token))
-	return ad.Login, errors.New("Failed")
+	return nil
+}
+
+func (mc *MemCache) GetSessions(login string) ([]Session, error) {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+	sessions := make([]Session, 0, len(mc.byLogin[login]))
+	for hash := range mc.byLogin[login] {
+		ad := mc.DB[hash]
+		if time.Since(ad.LastActive) > mc.Lifetime {
+			continue
+		}
+		sessions = append(sessions, ad.session())
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].CreatedAt.Equal(sessions[j].CreatedAt) {
+			return sessions[i].ID < sessions[j].ID
+		}
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+func (mc *MemCache) RevokeSession(login string, id string) error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	if _, exist := mc.byLogin[login][id]; !exist {
+		return ErrSessionNotFound
+	}
+	mc.delete(mc.DB[id])
+	mc.log.Debug(parent, fmt.Sprintf("Revoke Session of User: %s", login))
+	return nil
+}
+
+func (mc *MemCache) RevokeSessions(login string, except string) error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	for hash := range mc.byLogin[login] {
+		if hash != except {
+			mc.delete(mc.DB[hash])
+		}
+	}
+	mc.log.Debug(parent, fmt.Sprintf("Revoke All Sessions of User: %s", login))
+	return nil
 }
 
 func (mc *MemCache) HouseKeeper() error {
 	mc.log.Debug(parent, "HouseKeeper() Starts")
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
 	for _, ad := range mc.DB {
 		if time.Since(ad.LastActive) > mc.Lifetime {
-			mc.mutex.Lock()
-			delete(mc.DB, ad.Token)
-			mc.mutex.Unlock()
-			mc.log.Debug(parent, fmt.Sprintf("HouseKeeper() Delete Expired Token: %s", ad.Token))
+			mc.delete(ad)
+			mc.log.Debug(parent, fmt.Sprintf("HouseKeeper() Delete Expired Token of User: %s", ad.Login))
 		}
 	}
 	return nil
 }
+
+// delete removes session from both indexes, must be called under write lock
+func (mc *MemCache) delete(ad AuthData) {
+	delete(mc.DB, ad.TokenHash)
+	delete(mc.byLogin[ad.Login], ad.TokenHash)
+	if len(mc.byLogin[ad.Login]) == 0 {
+		delete(mc.byLogin, ad.Login)
+	}
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"aprokhorov-diploma-1/internal/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemCache_Sessions(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+	mc := NewMemCache(time.Minute, log)
+
+	assert.NoError(t, mc.StoreToken("User1", "token1", SessionMeta{UserAgent: "curl/7.0", IP: "127.0.0.1"}))
+	assert.NoError(t, mc.StoreToken("User1", "token2", SessionMeta{}))
+	assert.NoError(t, mc.StoreToken("User1", "token3", SessionMeta{}))
+	assert.NoError(t, mc.StoreToken("User2", "other", SessionMeta{}))
+
+	sessions, err := mc.GetSessions("User1")
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 3)
+	assert.Contains(t, sessions, Session{
+		ID:         SessionID("token1"),
+		CreatedAt:  mc.DB[SessionID("token1")].CreatedAt,
+		LastActive: mc.DB[SessionID("token1")].LastActive,
+		UserAgent:  "curl/7.0",
+		IP:         "127.0.0.1",
+	})
+
+	// Logout
+	assert.NoError(t, mc.RevokeToken("token1"))
+	_, err = mc.GetTokenUser("token1")
+	assert.Error(t, err)
+
+	// Refresh must not restore revoked session
+	assert.NoError(t, mc.RefreshToken("token1"))
+	_, err = mc.GetTokenUser("token1")
+	assert.Error(t, err)
+
+	// Session of other user can't be revoked
+	assert.ErrorIs(t, mc.RevokeSession("User1", SessionID("other")), ErrSessionNotFound)
+	assert.NoError(t, mc.RevokeSession("User1", SessionID("token2")))
+
+	// Log out everywhere except current
+	assert.NoError(t, mc.StoreToken("User1", "token4", SessionMeta{}))
+	assert.NoError(t, mc.RevokeSessions("User1", SessionID("token4")))
+	sessions, err = mc.GetSessions("User1")
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, SessionID("token4"), sessions[0].ID)
+
+	login, err := mc.GetTokenUser("other")
+	assert.NoError(t, err)
+	assert.Equal(t, "User2", login)
+}
@@ -0,0 +1,201 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"aprokhorov-diploma-1/internal/logger"
+)
+
+const parentPG string = "PGCache"
+
+// PGCache keeps sessions in Postgres Sessions table, so they survive restarts
+// and are shared between gophermart replicas. Only hash of token is stored.
+type PGCache struct {
+	DB         *sql.DB
+	log        logger.Logger
+	Lifetime   time.Duration
+	Statements PGCacheStatements
+}
+
+type PGCacheStatements struct {
+	InsertSession  *sql.Stmt
+	TouchSession   *sql.Stmt
+	SelectSession  *sql.Stmt
+	SelectSessions *sql.Stmt
+	DeleteSession  *sql.Stmt
+	DeleteSessions *sql.Stmt
+	DeleteExpired  *sql.Stmt
+}
+
+func NewPGCache(ctx context.Context, db *sql.DB, timeout time.Duration, log logger.Logger) (*PGCache, error) {
+	pc := &PGCache{
+		DB:       db,
+		log:      log,
+		Lifetime: timeout,
+	}
+
+	stmt, err := db.PrepareContext(ctx, `INSERT INTO Sessions (token_hash, login, created_at, last_active, expires_at, user_agent, ip)
+		VALUES ($1, $2, $3, $3, $4, $5, $6)`)
+	if err != nil {
+		return nil, err
+	}
+	pc.Statements.InsertSession = stmt
+
+	stmt, err = db.PrepareContext(ctx, "UPDATE Sessions SET last_active = $2, expires_at = $3 WHERE token_hash = $1")
+	if err != nil {
+		return nil, err
+	}
+	pc.Statements.TouchSession = stmt
+
+	stmt, err = db.PrepareContext(ctx, "SELECT login FROM Sessions WHERE token_hash = $1 AND expires_at > $2")
+	if err != nil {
+		return nil, err
+	}
+	pc.Statements.SelectSession = stmt
+
+	stmt, err = db.PrepareContext(ctx, `SELECT token_hash, created_at, last_active, user_agent, ip FROM Sessions
+		WHERE login = $1 AND expires_at > $2 ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	pc.Statements.SelectSessions = stmt
+
+	stmt, err = db.PrepareContext(ctx, "DELETE FROM Sessions WHERE token_hash = $1 AND (login = $2 OR $2 = '')")
+	if err != nil {
+		return nil, err
+	}
+	pc.Statements.DeleteSession = stmt
+
+	stmt, err = db.PrepareContext(ctx, "DELETE FROM Sessions WHERE login = $1 AND token_hash != $2")
+	if err != nil {
+		return nil, err
+	}
+	pc.Statements.DeleteSessions = stmt
+
+	stmt, err = db.PrepareContext(ctx, "DELETE FROM Sessions WHERE expires_at <= $1")
+	if err != nil {
+		return nil, err
+	}
+	pc.Statements.DeleteExpired = stmt
+
+	return pc, nil
+}
+
+func (pc *PGCache) GetLifetime() time.Duration {
+	return pc.Lifetime
+}
+
+func (pc *PGCache) StoreToken(login string, token string, meta SessionMeta) error {
+	now := time.Now()
+	_, err := pc.Statements.InsertSession.ExecContext(context.Background(), hashToken(token), login, now, now.Add(pc.Lifetime), meta.UserAgent, meta.IP)
+	if err != nil {
+		return err
+	}
+	pc.log.Debug(parentPG, fmt.Sprintf("Store Token for User: %s", login))
+	return nil
+}
+
+func (pc *PGCache) RefreshToken(token string) error {
+	now := time.Now()
+	_, err := pc.Statements.TouchSession.ExecContext(context.Background(), hashToken(token), now, now.Add(pc.Lifetime))
+	return err
+}
+
+func (pc *PGCache) GetTokenUser(token string) (string, error) {
+	var login string
+	err := pc.Statements.SelectSession.QueryRowContext(context.Background(), hashToken(token), time.Now()).Scan(&login)
+	if errors.Is(err, sql.ErrNoRows) {
+		pc.log.Debug(parentPG, "Verify() No User for Token or Token Expired")
+		return "", errors.New("please, log in")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	pc.log.Debug(parentPG, fmt.Sprintf("Verify() Successfully find Token for User: %s", login))
+	return login, nil
+}
+
+func (pc *PGCache) RevokeToken(token string) error {
+	_, err := pc.Statements.DeleteSession.ExecContext(context.Background(), hashToken(token), "")
+	return err
+}
+
+func (pc *PGCache) GetSessions(login string) ([]Session, error) {
+	rows, err := pc.Statements.SelectSessions.QueryContext(context.Background(), login, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.CreatedAt, &s.LastActive, &s.UserAgent, &s.IP); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+func (pc *PGCache) RevokeSession(login string, id string) error {
+	if login == "" {
+		return ErrSessionNotFound
+	}
+	result, err := pc.Statements.DeleteSession.ExecContext(context.Background(), id, login)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrSessionNotFound
+	}
+	pc.log.Debug(parentPG, fmt.Sprintf("Revoke Session of User: %s", login))
+	return nil
+}
+
+func (pc *PGCache) RevokeSessions(login string, except string) error {
+	result, err := pc.Statements.DeleteSessions.ExecContext(context.Background(), login, except)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	pc.log.Debug(parentPG, fmt.Sprintf("Revoke %d Sessions of User: %s", rows, login))
+	return nil
+}
+
+func (pc *PGCache) HouseKeeper() error {
+	pc.log.Debug(parentPG, "HouseKeeper() Starts")
+	result, err := pc.Statements.DeleteExpired.ExecContext(context.Background(), time.Now())
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	pc.log.Debug(parentPG, fmt.Sprintf("HouseKeeper() Delete %d Expired Sessions", rows))
+	return nil
+}
+
+// Close releases prepared statements, database itself is closed by its owner
+func (pc *PGCache) Close() {
+	pc.Statements.InsertSession.Close()
+	pc.Statements.TouchSession.Close()
+	pc.Statements.SelectSession.Close()
+	pc.Statements.SelectSessions.Close()
+	pc.Statements.DeleteSession.Close()
+	pc.Statements.DeleteSessions.Close()
+	pc.Statements.DeleteExpired.Close()
+}
@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"aprokhorov-diploma-1/internal/logger"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMockPGCache(t *testing.T) (*PGCache, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mock.ExpectPrepare(`INSERT INTO Sessions \(token_hash, login, created_at, last_active, expires_at, user_agent, ip\)`)
+	mock.ExpectPrepare(`UPDATE Sessions SET last_active = \$2, expires_at = \$3 WHERE token_hash = \$1`)
+	mock.ExpectPrepare(`SELECT login FROM Sessions WHERE token_hash = \$1 AND expires_at > \$2`)
+	mock.ExpectPrepare(`SELECT token_hash, created_at, last_active, user_agent, ip FROM Sessions`)
+	mock.ExpectPrepare(`DELETE FROM Sessions WHERE token_hash = \$1`)
+	mock.ExpectPrepare(`DELETE FROM Sessions WHERE login = \$1 AND token_hash != \$2`)
+	mock.ExpectPrepare(`DELETE FROM Sessions WHERE expires_at <= \$1`)
+
+	log, _ := logger.NewZeroLogger("error")
+	pc, err := NewPGCache(context.Background(), db, time.Minute, log)
+	assert.NoError(t, err)
+	return pc, mock
+}
+
+func TestPGCache_StoreToken(t *testing.T) {
+	pc, mock := newMockPGCache(t)
+
+	// Token itself never reaches database
+	mock.ExpectExec(`INSERT INTO Sessions`).
+		WithArgs(hashToken("token"), "User1", sqlmock.AnyArg(), sqlmock.AnyArg(), "curl/7.0", "127.0.0.1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT login FROM Sessions`).
+		WithArgs(hashToken("token"), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"login"}).AddRow("User1"))
+	mock.ExpectQuery(`SELECT login FROM Sessions`).
+		WithArgs(hashToken("expired"), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"login"}))
+
+	assert.NoError(t, pc.StoreToken("User1", "token", SessionMeta{UserAgent: "curl/7.0", IP: "127.0.0.1"}))
+
+	login, err := pc.GetTokenUser("token")
+	assert.NoError(t, err)
+	assert.Equal(t, "User1", login)
+
+	login, err = pc.GetTokenUser("expired")
+	assert.Error(t, err)
+	assert.Equal(t, "", login)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPGCache_Sessions(t *testing.T) {
+	pc, mock := newMockPGCache(t)
+	created := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`SELECT token_hash, created_at, last_active, user_agent, ip FROM Sessions`).
+		WithArgs("User1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"token_hash", "created_at", "last_active", "user_agent", "ip"}).
+			AddRow(hashToken("token"), created, created, "curl/7.0", "127.0.0.1"))
+	mock.ExpectExec(`DELETE FROM Sessions WHERE token_hash = \$1`).
+		WithArgs("unknown", "User1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM Sessions WHERE token_hash = \$1`).
+		WithArgs(hashToken("token"), "User1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM Sessions WHERE login = \$1 AND token_hash != \$2`).
+		WithArgs("User1", "").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	sessions, err := pc.GetSessions("User1")
+	assert.NoError(t, err)
+	assert.Equal(t, []Session{
+		{ID: hashToken("token"), CreatedAt: created, LastActive: created, UserAgent: "curl/7.0", IP: "127.0.0.1"},
+	}, sessions)
+
+	assert.ErrorIs(t, pc.RevokeSession("User1", "unknown"), ErrSessionNotFound)
+	assert.NoError(t, pc.RevokeSession("User1", hashToken("token")))
+	assert.NoError(t, pc.RevokeSessions("User1", ""))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
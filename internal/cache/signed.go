@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"aprokhorov-diploma-1/internal/hasher"
+	"aprokhorov-diploma-1/internal/logger"
+)
+
+const parentSigned string = "SignedCache"
+
+// SigningKey is a secret to sign tokens with, ID is put into token to find the key on verification
+type SigningKey struct {
+	ID     string
+	Secret string
+}
+
+// ParseSigningKey parses key in "id:secret" form
+func ParseSigningKey(s string) (SigningKey, error) {
+	id, secret, found := strings.Cut(s, ":")
+	if !found || id == "" || secret == "" {
+		return SigningKey{}, errors.New("signing key must be in id:secret form")
+	}
+	return SigningKey{ID: id, Secret: secret}, nil
+}
+
+// tokenClaims is a signed part of token
+type tokenClaims struct {
+	Login        string `json:"sub"`
+	IssuedAt     int64  `json:"iat"`
+	Expires      int64  `json:"exp"`
+	KeyID        string `json:"kid"`
+	SessionStart int64  `json:"sst"`
+	Version      int64  `json:"ver"`
+}
+
+// TokenVersions keeps per-user version of signed tokens, token of other version is revoked.
+// Missed user is ErrUnknownUser.
+type TokenVersions interface {
+	GetTokenVersion(ctx context.Context, login string) (int64, error)
+	BumpTokenVersion(ctx context.Context, login string) (int64, error)
+}
+
+// SignedCache is AuthCache keeping no sessions: token carries login, expiry, session start
+// and token version signed with HMAC. Only version of user is looked up on verification,
+// bumping it revokes all tokens of user. Session ends after max age however often token
+// is reissued. Tokens signed with previous key are accepted during grace period after rotation.
+type SignedCache struct {
+	hasher        hasher.Hasher
+	current       SigningKey
+	previous      SigningKey
+	previousUntil time.Time
+	versions      TokenVersions
+	log           logger.Logger
+	Lifetime      time.Duration
+	MaxAge        time.Duration
+}
+
+// NewSignedCache creates SignedCache, previous key with empty ID means there is no previous key
+func NewSignedCache(h hasher.Hasher, current SigningKey, previous SigningKey, grace time.Duration, timeout time.Duration, maxAge time.Duration, versions TokenVersions, log logger.Logger) *SignedCache {
+	return &SignedCache{
+		hasher:        h,
+		current:       current,
+		previous:      previous,
+		previousUntil: time.Now().Add(grace),
+		versions:      versions,
+		log:           log,
+		Lifetime:      timeout,
+		MaxAge:        maxAge,
+	}
+}
+
+func (sc *SignedCache) GetLifetime() time.Duration {
+	return sc.Lifetime
+}
+
+// IssueToken signs token of new session for login with current key and version of user
+func (sc *SignedCache) IssueToken(ctx context.Context, login string) (string, error) {
+	version, err := sc.versions.GetTokenVersion(ctx, login)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return sc.sign(tokenClaims{Login: login, SessionStart: now.Unix(), Version: version}, now)
+}
+
+// ReissueToken prolongs valid token, session start and version are kept,
+// so expiry never gets beyond session max age
+func (sc *SignedCache) ReissueToken(ctx context.Context, token string) (string, string, error) {
+	claims, err := sc.verify(ctx, token)
+	if err != nil {
+		return "", "", err
+	}
+	reissued, err := sc.sign(claims, time.Now())
+	if err != nil {
+		return "", "", err
+	}
+	return claims.Login, reissued, nil
+}
+
+// sign sets issue time, expiry and current key of claims and signs them
+func (sc *SignedCache) sign(claims tokenClaims, now time.Time) (string, error) {
+	claims.IssuedAt = now.Unix()
+	claims.Expires = now.Add(sc.Lifetime).Unix()
+	if sessionEnd := claims.SessionStart + int64(sc.MaxAge/time.Second); claims.Expires > sessionEnd {
+		claims.Expires = sessionEnd
+	}
+	claims.KeyID = sc.current.ID
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	sc.log.Debug(parentSigned, fmt.Sprintf("Issue Token for User: %s", claims.Login))
+	return payload + "." + sc.hasher.GetHash(payload, sc.current.Secret), nil
+}
+
+// StoreToken does nothing, tokens are not stored
+func (sc *SignedCache) StoreToken(login string, token string, meta SessionMeta) error {
+	return nil
+}
+
+// RefreshToken does nothing, token is reissued instead
+func (sc *SignedCache) RefreshToken(token string) error {
+	return nil
+}
+
+// RevokeToken is not supported, single signed token stays valid until it expires
+func (sc *SignedCache) RevokeToken(token string) error {
+	return ErrNotSupported
+}
+
+func (sc *SignedCache) GetSessions(login string) ([]Session, error) {
+	return nil, ErrNotSupported
+}
+
+func (sc *SignedCache) RevokeSession(login string, id string) error {
+	return ErrNotSupported
+}
+
+// RevokeSessions bumps token version of login, so every token of it is revoked,
+// except is ignored and caller has to issue new token for session it keeps
+func (sc *SignedCache) RevokeSessions(login string, except string) error {
+	version, err := sc.versions.BumpTokenVersion(context.Background(), login)
+	if err != nil {
+		return err
+	}
+	sc.log.Info(parentSigned, fmt.Sprintf("Tokens of User %s revoked, version: %d", login, version))
+	return nil
+}
+
+func (sc *SignedCache) GetTokenUser(token string) (string, error) {
+	claims, err := sc.verify(context.Background(), token)
+	if err != nil {
+		return "", err
+	}
+
+	sc.log.Debug(parentSigned, fmt.Sprintf("Verify() Successfully verify Token for User: %s", claims.Login))
+	return claims.Login, nil
+}
+
+// verify checks signature, expiry, session age and version of token and returns its claims
+func (sc *SignedCache) verify(ctx context.Context, token string) (tokenClaims, error) {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return tokenClaims{}, errors.New("malformed token. please, log in")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return tokenClaims{}, errors.New("malformed token. please, log in")
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return tokenClaims{}, errors.New("malformed token. please, log in")
+	}
+
+	key, err := sc.key(claims.KeyID)
+	if err != nil {
+		sc.log.Debug(parentSigned, fmt.Sprintf("Verify() %s, User: %s", err.Error(), claims.Login))
+		return tokenClaims{}, err
+	}
+
+	expected := sc.hasher.GetHash(payload, key.Secret)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		sc.log.Debug(parentSigned, fmt.Sprintf("Verify() Bad Signature for User: %s", claims.Login))
+		return tokenClaims{}, errors.New("bad signature. please, log in")
+	}
+
+	now := time.Now()
+	if now.Unix() >= claims.Expires {
+		sc.log.Debug(parentSigned, fmt.Sprintf("Verify() Token Expired for User: %s", claims.Login))
+		return tokenClaims{}, errors.New("expired. please, log in")
+	}
+	if now.Sub(time.Unix(claims.SessionStart, 0)) >= sc.MaxAge {
+		sc.log.Debug(parentSigned, fmt.Sprintf("Verify() Session too old for User: %s", claims.Login))
+		return tokenClaims{}, errors.New("session expired. please, log in")
+	}
+
+	// Deleted user has no version, its tokens are rejected too
+	version, err := sc.versions.GetTokenVersion(ctx, claims.Login)
+	if errors.Is(err, ErrUnknownUser) {
+		sc.log.Debug(parentSigned, fmt.Sprintf("Verify() Unknown User: %s", claims.Login))
+		return tokenClaims{}, errors.New("unknown user. please, log in")
+	}
+	if err != nil {
+		return tokenClaims{}, err
+	}
+	if version != claims.Version {
+		sc.log.Debug(parentSigned, fmt.Sprintf("Verify() Token Revoked for User: %s", claims.Login))
+		return tokenClaims{}, errors.New("revoked. please, log in")
+	}
+
+	return claims, nil
+}
+
+// key finds signing key by id, previous key is valid only till end of grace period
+func (sc *SignedCache) key(id string) (SigningKey, error) {
+	if id == sc.current.ID {
+		return sc.current, nil
+	}
+	if sc.previous.ID != "" && id == sc.previous.ID {
+		if time.Now().Before(sc.previousUntil) {
+			return sc.previous, nil
+		}
+		return SigningKey{}, errors.New("signing key retired. please, log in")
+	}
+	return SigningKey{}, errors.New("unknown signing key. please, log in")
+}
+
+// HouseKeeper does nothing, expired tokens are just rejected
+func (sc *SignedCache) HouseKeeper() error {
+	return nil
+}
@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"aprokhorov-diploma-1/internal/hasher"
+	"aprokhorov-diploma-1/internal/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testVersions is TokenVersions of known users
+type testVersions map[string]int64
+
+func (v testVersions) GetTokenVersion(ctx context.Context, login string) (int64, error) {
+	version, ok := v[login]
+	if !ok {
+		return 0, ErrUnknownUser
+	}
+	return version, nil
+}
+
+func (v testVersions) BumpTokenVersion(ctx context.Context, login string) (int64, error) {
+	if _, ok := v[login]; !ok {
+		return 0, ErrUnknownUser
+	}
+	v[login]++
+	return v[login], nil
+}
+
+func TestSignedCache_GetTokenUser(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+	h := hasher.NewHMAC()
+	oldKey := SigningKey{ID: "k1", Secret: "old-secret"}
+	newKey := SigningKey{ID: "k2", Secret: "new-secret"}
+	versions := testVersions{"User1": 0, "Admin": 0}
+	newSigned := func(current SigningKey, previous SigningKey, grace time.Duration, lifetime time.Duration) *SignedCache {
+		return NewSignedCache(h, current, previous, grace, lifetime, time.Hour, versions, log)
+	}
+
+	tests := []struct {
+		name      string
+		issuer    *SignedCache
+		verifier  *SignedCache
+		tamper    func(token string) string
+		wantLogin string
+		wantErr   bool
+	}{
+		{
+			name:      "Valid token",
+			issuer:    newSigned(newKey, SigningKey{}, 0, time.Minute),
+			verifier:  newSigned(newKey, SigningKey{}, 0, time.Minute),
+			wantLogin: "User1",
+		},
+		{
+			name:     "Expired token",
+			issuer:   newSigned(newKey, SigningKey{}, 0, -time.Second),
+			verifier: newSigned(newKey, SigningKey{}, 0, time.Minute),
+			wantErr:  true,
+		},
+		{
+			name:     "Tampered login",
+			issuer:   newSigned(newKey, SigningKey{}, 0, time.Minute),
+			verifier: newSigned(newKey, SigningKey{}, 0, time.Minute),
+			tamper: func(token string) string {
+				other, _ := newSigned(SigningKey{ID: "k2", Secret: "guess"}, SigningKey{}, 0, time.Minute).IssueToken(context.Background(), "Admin")
+				payload, _, _ := strings.Cut(other, ".")
+				_, signature, _ := strings.Cut(token, ".")
+				return payload + "." + signature
+			},
+			wantErr: true,
+		},
+		{
+			name:      "Previous key during grace period",
+			issuer:    newSigned(oldKey, SigningKey{}, 0, time.Minute),
+			verifier:  newSigned(newKey, oldKey, time.Hour, time.Minute),
+			wantLogin: "User1",
+		},
+		{
+			name:     "Previous key after grace period",
+			issuer:   newSigned(oldKey, SigningKey{}, 0, time.Minute),
+			verifier: newSigned(newKey, oldKey, 0, time.Minute),
+			wantErr:  true,
+		},
+		{
+			name:     "Unknown key",
+			issuer:   newSigned(SigningKey{ID: "k3", Secret: "other"}, SigningKey{}, 0, time.Minute),
+			verifier: newSigned(newKey, oldKey, time.Hour, time.Minute),
+			wantErr:  true,
+		},
+		{
+			name:     "Malformed token",
+			issuer:   newSigned(newKey, SigningKey{}, 0, time.Minute),
+			verifier: newSigned(newKey, SigningKey{}, 0, time.Minute),
+			tamper:   func(token string) string { return "garbage" },
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.issuer.IssueToken(context.Background(), "User1")
+			assert.NoError(t, err)
+			if tt.tamper != nil {
+				token = tt.tamper(token)
+			}
+
+			login, err := tt.verifier.GetTokenUser(token)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Equal(t, "", login)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantLogin, login)
+		})
+	}
+}
+
+func TestSignedCache_Session(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+	key := SigningKey{ID: "k1", Secret: "secret"}
+
+	tests := []struct {
+		name    string
+		maxAge  time.Duration
+		change  func(sc *SignedCache, versions testVersions)
+		wantErr bool
+	}{
+		{
+			name:   "Reissued token keeps session",
+			maxAge: time.Hour,
+		},
+		{
+			name:    "Session older than max age",
+			maxAge:  time.Second,
+			change:  func(sc *SignedCache, versions testVersions) { time.Sleep(time.Second) },
+			wantErr: true,
+		},
+		{
+			name:   "Revoked tokens",
+			maxAge: time.Hour,
+			change: func(sc *SignedCache, versions testVersions) {
+				require.NoError(t, sc.RevokeSessions("User1", ""))
+			},
+			wantErr: true,
+		},
+		{
+			name:    "Deleted user",
+			maxAge:  time.Hour,
+			change:  func(sc *SignedCache, versions testVersions) { delete(versions, "User1") },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versions := testVersions{"User1": 0}
+			sc := NewSignedCache(hasher.NewHMAC(), key, SigningKey{}, 0, time.Hour, tt.maxAge, versions, log)
+
+			token, err := sc.IssueToken(context.Background(), "User1")
+			require.NoError(t, err)
+			login, reissued, err := sc.ReissueToken(context.Background(), token)
+			require.NoError(t, err)
+			assert.Equal(t, "User1", login)
+			if tt.change != nil {
+				tt.change(sc, versions)
+			}
+
+			for _, token := range []string{token, reissued} {
+				login, err := sc.GetTokenUser(token)
+				if tt.wantErr {
+					assert.Error(t, err)
+					continue
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, "User1", login)
+			}
+			_, _, err = sc.ReissueToken(context.Background(), token)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
@@ -4,4 +4,6 @@ type Hasher interface {
 	RandomKey() (string, error)
 	GenerateToken() (string, error)
 	GetHash(password string, key string) string
+	HashPassword(password string) (string, error)
+	VerifyPassword(password string, encoded string, key string) (ok bool, rehash bool, err error)
 }
@@ -2,18 +2,34 @@ package hasher
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
-	"math/rand"
-	"strings"
 )
 
-const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890!@#$%^&*()?|><.,][}{:`~"
+// Sizes of random values in bytes
+const (
+	keySize   = 16 // 128-bit per-user keys
+	tokenSize = 32 // 256-bit session tokens
+)
 
-type HMAC struct{}
+// HMAC hashes with HMAC-SHA256 and generates random keys and tokens,
+// passwords are hashed with PasswordAlgorithm (argon2id by default)
+type HMAC struct {
+	PasswordAlgorithm string
+}
 
 func NewHMAC() HMAC {
-	return HMAC{}
+	return HMAC{PasswordAlgorithm: Argon2id}
+}
+
+// NewHMACWithPassword creates HMAC hashing passwords with given algorithm: argon2id or bcrypt
+func NewHMACWithPassword(algorithm string) (HMAC, error) {
+	if algorithm != Argon2id && algorithm != Bcrypt {
+		return HMAC{}, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, algorithm)
+	}
+	return HMAC{PasswordAlgorithm: algorithm}, nil
 }
 
 func (hm HMAC) GetHash(src string, key string) string {
@@ -23,15 +39,18 @@ func (hm HMAC) GetHash(src string, key string) string {
 }
 
 func (hm HMAC) RandomKey() (string, error) {
-	var n = 16
-	sb := strings.Builder{}
-	sb.Grow(n)
-	for i := 0; i < n; i++ {
-		sb.WriteByte(charset[rand.Intn(len(charset))])
-	}
-	return sb.String(), nil
+	return randomString(keySize)
 }
 
 func (hm HMAC) GenerateToken() (string, error) {
-	return hm.RandomKey()
+	return randomString(tokenSize)
+}
+
+// randomString returns n cryptographically secure random bytes in URL-safe base64
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
@@ -0,0 +1,89 @@
+package hasher
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHMAC_GenerateToken(t *testing.T) {
+	hm := NewHMAC()
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		token, err := hm.GenerateToken()
+		assert.NoError(t, err)
+
+		raw, err := base64.RawURLEncoding.DecodeString(token)
+		assert.NoError(t, err, "token must be URL-safe base64")
+		assert.Len(t, raw, 32, "token must have 256 bits")
+
+		assert.False(t, seen[token], "tokens must not repeat")
+		seen[token] = true
+	}
+}
+
+func TestHMAC_RandomKey(t *testing.T) {
+	hm := NewHMAC()
+
+	key1, err := hm.RandomKey()
+	assert.NoError(t, err)
+	key2, err := hm.RandomKey()
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, key1, key2)
+	assert.NotEqual(t, hm.GetHash("password", key1), hm.GetHash("password", key2))
+}
+
+func TestHMAC_VerifyPassword(t *testing.T) {
+	argon := NewHMAC()
+	bcrypt, err := NewHMACWithPassword(Bcrypt)
+	assert.NoError(t, err)
+
+	argonHash, err := argon.HashPassword("password")
+	assert.NoError(t, err)
+	bcryptHash, err := bcrypt.HashPassword("password")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		hasher     HMAC
+		password   string
+		encoded    string
+		key        string
+		wantOK     bool
+		wantRehash bool
+	}{
+		{name: "argon2id hash", hasher: argon, password: "password", encoded: argonHash, wantOK: true},
+		{name: "argon2id wrong password", hasher: argon, password: "wrong", encoded: argonHash},
+		{name: "bcrypt hash", hasher: bcrypt, password: "password", encoded: bcryptHash, wantOK: true},
+		{name: "bcrypt wrong password", hasher: bcrypt, password: "wrong", encoded: bcryptHash},
+		{name: "bcrypt hash with argon2id configured", hasher: argon, password: "password", encoded: bcryptHash, wantOK: true, wantRehash: true},
+		{name: "argon2id hash with bcrypt configured", hasher: bcrypt, password: "password", encoded: argonHash, wantOK: true, wantRehash: true},
+		{name: "legacy HMAC hash", hasher: argon, password: "password", encoded: argon.GetHash("password", "key"), key: "key", wantOK: true, wantRehash: true},
+		{name: "legacy HMAC wrong password", hasher: argon, password: "wrong", encoded: argon.GetHash("password", "key"), key: "key", wantRehash: true},
+		{name: "weaker argon2id parameters", hasher: argon, password: "password", encoded: "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$CkfxhW+4Z96AKn8zgwIs0RVCwTgBwZFGr7CKbAK8hA0", wantOK: false, wantRehash: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := tt.hasher.VerifyPassword(tt.password, tt.encoded, tt.key)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantRehash, rehash)
+		})
+	}
+
+	for _, params := range []string{"m=4194304,t=2,p=1", "m=19456,t=1000,p=1", "m=19456,t=2,p=255", "m=19456,t=0,p=1", "m=19456,t=2,p=0"} {
+		encoded := "$argon2id$v=19$" + params + "$c2FsdHNhbHQ$CkfxhW+4Z96AKn8zgwIs0RVCwTgBwZFGr7CKbAK8hA0"
+		ok, _, err := argon.VerifyPassword("password", encoded, "")
+		assert.ErrorIs(t, err, ErrHashParams, params)
+		assert.False(t, ok, params)
+	}
+
+	_, _, err = argon.VerifyPassword("password", "$scrypt$whatever", "")
+	assert.ErrorIs(t, err, ErrUnknownAlgorithm)
+
+	_, err = NewHMACWithPassword("md5")
+	assert.ErrorIs(t, err, ErrUnknownAlgorithm)
+}
@@ -0,0 +1,131 @@
+package hasher
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// argon2id parameters, see OWASP Password Storage Cheat Sheet
+const (
+	argonMemory  uint32 = 19 * 1024
+	argonTime    uint32 = 2
+	argonThreads uint8  = 1
+	argonKeyLen  uint32 = 32
+	argonSaltLen        = 16
+	// Stored parameters above configured ones times argonMaxFactor are refused,
+	// so tampered hash cannot make verification allocate gigabytes or run for minutes
+	argonMaxFactor = 4
+)
+
+const bcryptCost = bcrypt.DefaultCost
+
+// ErrUnknownAlgorithm is returned for password hash in unsupported format
+var ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+
+// ErrHashParams is returned for password hash with parameters out of allowed range
+var ErrHashParams = errors.New("password hash parameters out of range")
+
+// HashPassword encodes password with configured algorithm. Result carries algorithm,
+// its parameters and salt, e.g. $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+func (hm HMAC) HashPassword(password string) (string, error) {
+	switch hm.passwordAlgorithm() {
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	default:
+		salt := make([]byte, argonSaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		hash := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+		return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			Argon2id, argon2.Version, argonMemory, argonTime, argonThreads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(hash),
+		), nil
+	}
+}
+
+// VerifyPassword checks password against encoded hash. Legacy hashes without "$" prefix
+// are HMAC-SHA256 of password keyed with key. rehash reports that hash was made with
+// other algorithm or weaker parameters than configured and should be upgraded.
+func (hm HMAC) VerifyPassword(password string, encoded string, key string) (ok bool, rehash bool, err error) {
+	switch {
+	case !strings.HasPrefix(encoded, "$"):
+		ok = hmac.Equal([]byte(hm.GetHash(password, key)), []byte(encoded))
+		return ok, true, nil
+
+	case strings.HasPrefix(encoded, "$"+Argon2id+"$"):
+		var version int
+		var memory, time uint32
+		var threads uint8
+		parts := strings.Split(encoded, "$")
+		if len(parts) != 6 {
+			return false, false, fmt.Errorf("malformed %s hash", Argon2id)
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+			return false, false, err
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+			return false, false, err
+		}
+		if memory > argonMemory*argonMaxFactor || time < 1 || time > argonTime*argonMaxFactor ||
+			threads < 1 || threads > argonThreads*argonMaxFactor {
+			return false, false, ErrHashParams
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, false, err
+		}
+		hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false, false, err
+		}
+
+		actual := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+		ok = subtle.ConstantTimeCompare(actual, hash) == 1
+		rehash = hm.passwordAlgorithm() != Argon2id || version != argon2.Version ||
+			memory < argonMemory || time < argonTime || threads < argonThreads
+		return ok, rehash, nil
+
+	case strings.HasPrefix(encoded, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		cost, err := bcrypt.Cost([]byte(encoded))
+		if err != nil {
+			return false, false, err
+		}
+		return true, hm.passwordAlgorithm() != Bcrypt || cost < bcryptCost, nil
+	}
+
+	return false, false, ErrUnknownAlgorithm
+}
+
+func (hm HMAC) passwordAlgorithm() string {
+	if hm.PasswordAlgorithm == "" {
+		return Argon2id
+	}
+	return hm.PasswordAlgorithm
+}
@@ -0,0 +1,161 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aprokhorov-diploma-1/internal/logger"
+)
+
+const parent string = "Health"
+
+// Statuses of component and of whole service
+const (
+	StatusOK           = "ok"
+	StatusFail         = "fail"
+	StatusDegraded     = "degraded" // optional component failed, service is still ready
+	StatusShuttingDown = "shutting_down"
+)
+
+// Check returns nil if component is healthy
+type Check func(ctx context.Context) error
+
+type ComponentStatus struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+type Report struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+type component struct {
+	check    Check
+	optional bool
+}
+
+// Checker runs dependency checks for readiness probe.
+// Failed component makes service not ready, unless it is optional.
+type Checker struct {
+	components   map[string]component
+	timeout      time.Duration
+	shuttingDown int32
+	log          logger.Logger
+}
+
+func New(timeout time.Duration, log logger.Logger) *Checker {
+	return &Checker{
+		components: make(map[string]component),
+		timeout:    timeout,
+		log:        log,
+	}
+}
+
+// Add registers component service can't work without, not safe to call while serving
+func (c *Checker) Add(name string, check Check) {
+	c.components[name] = component{check: check}
+}
+
+// AddOptional registers component which failure is reported, but keeps service ready
+func (c *Checker) AddOptional(name string, check Check) {
+	c.components[name] = component{check: check, optional: true}
+}
+
+// Shutdown makes service not ready, so balancer stops sending new requests
+func (c *Checker) Shutdown() {
+	atomic.StoreInt32(&c.shuttingDown, 1)
+}
+
+// Check runs all checks concurrently, every one limited by timeout
+func (c *Checker) Check(ctx context.Context) Report {
+	if atomic.LoadInt32(&c.shuttingDown) == 1 {
+		return Report{Status: StatusShuttingDown}
+	}
+
+	report := Report{Status: StatusOK, Components: make(map[string]ComponentStatus, len(c.components))}
+	mutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for name, comp := range c.components {
+		wg.Add(1)
+		go func(name string, comp component) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			status := ComponentStatus{Status: StatusOK, Optional: comp.optional}
+			if err := comp.check(checkCtx); err != nil {
+				status.Status = StatusFail
+				status.Error = err.Error()
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			report.Components[name] = status
+		}(name, comp)
+	}
+	wg.Wait()
+
+	// Stable order in log
+	names := make([]string, 0, len(report.Components))
+	for name := range report.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		status := report.Components[name]
+		if status.Status == StatusOK {
+			continue
+		}
+		c.log.Warning(parent, name+" check failed: "+status.Error)
+		if status.Optional {
+			if report.Status == StatusOK {
+				report.Status = StatusDegraded
+			}
+			continue
+		}
+		report.Status = StatusFail
+	}
+	return report
+}
+
+// Liveness answers 200 while process is able to serve HTTP
+func (c *Checker) Liveness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, http.StatusOK, Report{Status: StatusOK}, c.log)
+	}
+}
+
+// Readiness answers 200 with status of every component if service can take requests, 503 otherwise
+func (c *Checker) Readiness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := c.Check(r.Context())
+		status := http.StatusOK
+		if report.Status == StatusFail || report.Status == StatusShuttingDown {
+			status = http.StatusServiceUnavailable
+		}
+		writeReport(w, status, report, c.log)
+	}
+}
+
+func writeReport(w http.ResponseWriter, status int, report Report, log logger.Logger) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		log.Error(parent, err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, err = w.Write(body)
+	if err != nil {
+		log.Error(parent, err.Error())
+	}
+}
@@ -0,0 +1,119 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aprokhorov-diploma-1/internal/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecker_Readiness(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+	ok := func(ctx context.Context) error { return nil }
+	fail := func(ctx context.Context) error { return errors.New("connection refused") }
+	hang := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	tests := []struct {
+		name       string
+		required   Check
+		optional   Check
+		shutdown   bool
+		wantStatus int
+		wantReport string
+	}{
+		{
+			name:       "All components ok",
+			required:   ok,
+			optional:   ok,
+			wantStatus: http.StatusOK,
+			wantReport: StatusOK,
+		},
+		{
+			name:       "Optional component failed",
+			required:   ok,
+			optional:   fail,
+			wantStatus: http.StatusOK,
+			wantReport: StatusDegraded,
+		},
+		{
+			name:       "Required component failed",
+			required:   fail,
+			optional:   ok,
+			wantStatus: http.StatusServiceUnavailable,
+			wantReport: StatusFail,
+		},
+		{
+			name:       "Required component timed out",
+			required:   hang,
+			optional:   ok,
+			wantStatus: http.StatusServiceUnavailable,
+			wantReport: StatusFail,
+		},
+		{
+			name:       "Shutting down",
+			required:   ok,
+			optional:   ok,
+			shutdown:   true,
+			wantStatus: http.StatusServiceUnavailable,
+			wantReport: StatusShuttingDown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(10*time.Millisecond, log)
+			c.Add("database", tt.required)
+			c.AddOptional("accrual", tt.optional)
+			if tt.shutdown {
+				c.Shutdown()
+			}
+
+			w := httptest.NewRecorder()
+			c.Readiness()(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			assert.Equal(t, tt.wantStatus, w.Code)
+
+			var report Report
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+			assert.Equal(t, tt.wantReport, report.Status)
+			if !tt.shutdown {
+				assert.Len(t, report.Components, 2)
+				assert.True(t, report.Components["accrual"].Optional)
+			}
+		})
+	}
+}
+
+func TestChecker_Liveness(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+	c := New(time.Second, log)
+	c.Add("database", func(ctx context.Context) error { return errors.New("connection refused") })
+	c.Shutdown()
+
+	// Process is alive whatever dependencies are
+	w := httptest.NewRecorder()
+	c.Liveness()(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+}
+
+func TestHeartbeat_Check(t *testing.T) {
+	h := NewHeartbeat()
+	check := h.Check(50 * time.Millisecond)
+	assert.NoError(t, check(context.Background()))
+
+	h.last = time.Now().Add(-time.Second).UnixNano()
+	assert.Error(t, check(context.Background()))
+
+	h.Beat()
+	assert.NoError(t, check(context.Background()))
+}
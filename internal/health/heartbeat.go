@@ -0,0 +1,40 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Heartbeat remembers time of last successful run of background task
+type Heartbeat struct {
+	last int64 // unix nano
+}
+
+// NewHeartbeat starts counting age from now, so task has time for first run
+func NewHeartbeat() *Heartbeat {
+	h := &Heartbeat{}
+	h.Beat()
+	return h
+}
+
+// Beat implements cron.Heartbeat
+func (h *Heartbeat) Beat() {
+	atomic.StoreInt64(&h.last, time.Now().UnixNano())
+}
+
+// Age returns time passed since last beat
+func (h *Heartbeat) Age() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&h.last)))
+}
+
+// Check fails if there was no beat for longer than maxAge
+func (h *Heartbeat) Check(maxAge time.Duration) Check {
+	return func(ctx context.Context) error {
+		if age := h.Age(); age > maxAge {
+			return fmt.Errorf("last run %v ago, expected every %v", age.Round(time.Millisecond), maxAge)
+		}
+		return nil
+	}
+}
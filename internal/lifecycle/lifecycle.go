@@ -0,0 +1,159 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"aprokhorov-diploma-1/internal/logger"
+)
+
+const parent string = "Lifecycle"
+
+// ErrShutdownTimeout is returned by Shutdown when tasks did not finish in time
+var ErrShutdownTimeout = errors.New("shutdown timed out, tasks are still running")
+
+// Time given to tasks to return after detached work is cancelled on shutdown timeout
+const detachedGrace = 250 * time.Millisecond
+
+type stopKey struct{}
+
+type hook struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// Manager runs background tasks on root context and stops service in phases:
+// shutdown hooks (servers drain requests) in order of registration, then root context
+// is cancelled and tasks are waited for, then resources are closed in reverse order.
+type Manager struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stop    context.CancelFunc // cancels work detached from root context
+	tasks   *sync.WaitGroup
+	mutex   *sync.Mutex
+	hooks   []hook
+	closers []hook
+	log     logger.Logger
+}
+
+func New(log logger.Logger) *Manager {
+	stopCtx, stop := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), stopKey{}, stopCtx))
+	return &Manager{
+		ctx:    ctx,
+		cancel: cancel,
+		stop:   stop,
+		tasks:  &sync.WaitGroup{},
+		mutex:  &sync.Mutex{},
+		log:    log,
+	}
+}
+
+// Context is root context, cancelled on shutdown after hooks
+func (m *Manager) Context() context.Context {
+	return m.ctx
+}
+
+// Go runs task, which must return soon after its context is cancelled
+func (m *Manager) Go(name string, task func(ctx context.Context)) {
+	m.tasks.Add(1)
+	go func() {
+		defer m.tasks.Done()
+		task(m.ctx)
+		m.log.Debug(parent, name+" stopped")
+	}()
+}
+
+// Detach returns context with values of ctx, but not cancelled with it, so task can finish work it took.
+// If ctx comes from Manager, detached context is cancelled when shutdown timeout expires,
+// so detached work never runs on closed resources.
+func Detach(ctx context.Context) context.Context {
+	stopCtx, _ := ctx.Value(stopKey{}).(context.Context)
+	return detached{Context: ctx, stop: stopCtx}
+}
+
+type detached struct {
+	context.Context
+	stop context.Context // nil if never stopped
+}
+
+func (detached) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (d detached) Done() <-chan struct{} {
+	if d.stop == nil {
+		return nil
+	}
+	return d.stop.Done()
+}
+
+func (d detached) Err() error {
+	if d.stop == nil {
+		return nil
+	}
+	return d.stop.Err()
+}
+
+// OnShutdown registers hook run before tasks are stopped, ctx of hook expires with shutdown timeout
+func (m *Manager) OnShutdown(name string, run func(ctx context.Context) error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.hooks = append(m.hooks, hook{name: name, run: run})
+}
+
+// OnClose registers resource closed after all tasks are stopped, last registered is closed first
+func (m *Manager) OnClose(name string, close func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.closers = append(m.closers, hook{name: name, run: func(context.Context) error {
+		close()
+		return nil
+	}})
+}
+
+// Shutdown stops service, phases share timeout. When timeout is exceeded, detached work is cancelled
+// and tasks get short grace to return, then resources are closed anyway, so tasks still running may fail on them.
+func (m *Manager) Shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	m.mutex.Lock()
+	hooks := m.hooks
+	closers := m.closers
+	m.mutex.Unlock()
+
+	for _, h := range hooks {
+		if err := h.run(ctx); err != nil {
+			m.log.Error(parent, h.name+": "+err.Error())
+		}
+	}
+
+	m.cancel()
+	var result error
+	stopped := make(chan struct{})
+	go func() {
+		m.tasks.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		m.stop()
+		select {
+		case <-stopped:
+		case <-time.After(detachedGrace):
+		}
+		m.log.Error(parent, ErrShutdownTimeout.Error())
+		result = ErrShutdownTimeout
+	}
+	m.stop()
+
+	for i := len(closers) - 1; i >= 0; i-- {
+		m.log.Debug(parent, "close "+closers[i].name)
+		_ = closers[i].run(ctx)
+	}
+	return result
+}
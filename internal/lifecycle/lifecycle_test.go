@@ -0,0 +1,122 @@
+package lifecycle
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"aprokhorov-diploma-1/internal/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManager_Shutdown(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+
+	tests := []struct {
+		name      string
+		taskDelay time.Duration // time task needs after cancel
+		wantErr   error
+		wantOrder []string
+	}{
+		{
+			name:      "Phases in order",
+			taskDelay: 0,
+			wantErr:   nil,
+			wantOrder: []string{"server", "readiness", "task", "cache", "database"},
+		},
+		{
+			name:      "Task finishing current work is waited",
+			taskDelay: 20 * time.Millisecond,
+			wantErr:   nil,
+			wantOrder: []string{"server", "readiness", "task", "cache", "database"},
+		},
+		{
+			name:      "Resources are closed on timeout",
+			taskDelay: time.Second,
+			wantErr:   ErrShutdownTimeout,
+			wantOrder: []string{"server", "readiness", "cache", "database"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var order []string
+			mutex := &sync.Mutex{}
+			record := func(name string) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				order = append(order, name)
+			}
+
+			m := New(log)
+			m.OnClose("database", func() { record("database") })
+			m.OnClose("cache", func() { record("cache") })
+			m.OnShutdown("server", func(ctx context.Context) error {
+				// Root context is alive while requests are drained
+				assert.NoError(t, m.Context().Err())
+				record("server")
+				return nil
+			})
+			m.OnShutdown("readiness", func(ctx context.Context) error {
+				record("readiness")
+				return nil
+			})
+			m.Go("task", func(ctx context.Context) {
+				<-ctx.Done()
+				time.Sleep(tt.taskDelay)
+				record("task")
+			})
+
+			err := m.Shutdown(100 * time.Millisecond)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Error(t, m.Context().Err())
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			assert.Equal(t, tt.wantOrder, order)
+		})
+	}
+}
+
+func TestManager_ShutdownDetached(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+
+	var order []string
+	mutex := &sync.Mutex{}
+	record := func(name string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		order = append(order, name)
+	}
+
+	m := New(log)
+	m.OnClose("database", func() { record("database") })
+	m.Go("task", func(ctx context.Context) {
+		<-ctx.Done()
+		// Detached work outlives root context, but not shutdown timeout
+		detached := Detach(ctx)
+		assert.NoError(t, detached.Err())
+		<-detached.Done()
+		record("task")
+	})
+
+	err := m.Shutdown(50 * time.Millisecond)
+	assert.ErrorIs(t, err, ErrShutdownTimeout)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"task", "database"}, order)
+}
+
+func TestDetach(t *testing.T) {
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "value"))
+	cancel()
+
+	// Without Manager detached context is never cancelled
+	detached := Detach(ctx)
+	assert.Nil(t, detached.Done())
+	assert.NoError(t, detached.Err())
+	assert.Equal(t, "value", detached.Value(key{}))
+}
@@ -1,5 +1,7 @@
 package logger
 
+import "context"
+
 type Logger interface {
 	Debug(parent string, message string)
 	Info(parent string, message string)
@@ -7,4 +9,37 @@ type Logger interface {
 	Error(parent string, message string)
 	Fatal(parent string, message string)
 	Panic(parent string, message string)
+	// With returns logger adding key=value field to every line
+	With(key string, value string) Logger
+}
+
+type contextKey string
+
+const (
+	loggerKey    contextKey = "logger"
+	requestIDKey contextKey = "request_id"
+)
+
+// NewContext returns copy of ctx carrying log
+func NewContext(ctx context.Context, log Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, log)
+}
+
+// FromContext returns logger carried by ctx, fallback if there is none
+func FromContext(ctx context.Context, fallback Logger) Logger {
+	if log, ok := ctx.Value(loggerKey).(Logger); ok {
+		return log
+	}
+	return fallback
+}
+
+// WithRequestID returns copy of ctx carrying id of request
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns id of request carried by ctx, empty if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
 }
@@ -44,3 +44,7 @@ func (z *ZeroLogger) Fatal(parent string, msg string) {
 func (z *ZeroLogger) Panic(parent string, msg string) {
 	z.Logger.Panic().Timestamp().Msg(fmt.Sprintf("\x1b[33m%s\x1b[0m: %s", strings.ToUpper(parent), msg))
 }
+
+func (z *ZeroLogger) With(key string, value string) Logger {
+	return &ZeroLogger{Logger: z.Logger.With().Str(key, value).Logger()}
+}
@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gophermart"
+
+// Route label for requests not matched by router, keeps label cardinality bounded
+const unmatchedRoute = "unmatched"
+
+// Metrics collects service metrics in own registry and exposes them for Prometheus.
+// It implements observers of storage, accrual service and accrual cron.
+type Metrics struct {
+	Registry        *prometheus.Registry
+	httpDuration    *prometheus.HistogramVec
+	storageDuration *prometheus.HistogramVec
+	accrualRequests *prometheus.CounterVec
+	accrualDuration prometheus.Histogram
+	cronTick        prometheus.Histogram
+	cronBacklog     prometheus.Gauge
+	ledgerMismatch  prometheus.Gauge
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of HTTP requests by route pattern, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "statement_duration_seconds",
+			Help:      "Duration of prepared statements by statement and result.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"statement", "result"}),
+		accrualRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "accrual",
+			Name:      "requests_total",
+			Help:      "Requests to accrual service by response status code, 0 if request failed.",
+		}, []string{"code"}),
+		accrualDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "accrual",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of requests to accrual service.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		cronTick: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "accrual_cron",
+			Name:      "tick_duration_seconds",
+			Help:      "Duration of accrual cron tick, until all undone orders are handed to workers.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		cronBacklog: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "accrual_cron",
+			Name:      "undone_orders",
+			Help:      "Undone orders found on last accrual cron tick.",
+		}),
+		ledgerMismatch: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "ledger",
+			Name:      "balance_mismatches",
+			Help:      "Balances disagreeing with Ledger found on last reconciliation.",
+		}),
+	}
+
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpDuration,
+		m.storageDuration,
+		m.accrualRequests,
+		m.accrualDuration,
+		m.cronTick,
+		m.cronBacklog,
+		m.ledgerMismatch,
+	)
+	return m
+}
+
+// Handler serves metrics in Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{Registry: m.Registry})
+}
+
+// Middleware observes duration of requests labeled by chi route pattern, not by raw path,
+// so it must be used on router itself
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := unmatchedRoute
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		m.httpDuration.WithLabelValues(route, r.Method, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// ObserveStatement implements storage.StatementObserver, no rows is a valid result, not an error
+func (m *Metrics) ObserveStatement(statement string, duration time.Duration, err error) {
+	result := "ok"
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		result = "error"
+	}
+	m.storageDuration.WithLabelValues(statement, result).Observe(duration.Seconds())
+}
+
+// ObserveAccrual implements accrual.Observer
+func (m *Metrics) ObserveAccrual(code int, duration time.Duration) {
+	m.accrualRequests.WithLabelValues(strconv.Itoa(code)).Inc()
+	m.accrualDuration.Observe(duration.Seconds())
+}
+
+// ObserveTick implements cron.Observer
+func (m *Metrics) ObserveTick(duration time.Duration, backlog int) {
+	m.cronTick.Observe(duration.Seconds())
+	m.cronBacklog.Set(float64(backlog))
+}
+
+// ObserveReconcile sets number of balances disagreeing with Ledger
+func (m *Metrics) ObserveReconcile(mismatches int) {
+	m.ledgerMismatch.Set(float64(mismatches))
+}
+
+// RegisterGauge exposes value returned by f on every scrape
+func (m *Metrics) RegisterGauge(subsystem string, name string, help string, f func() float64) error {
+	return m.Registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+	}, f))
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics_Middleware(t *testing.T) {
+	m := New()
+	r := chi.NewRouter()
+	r.Use(m.Middleware)
+	r.Get("/api/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	r.Get("/api/orders", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("[]"))
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		route  string
+		status string
+	}{
+		{
+			name:   "Path parameter is not a label",
+			path:   "/api/sessions/4f2a",
+			route:  "/api/sessions/{id}",
+			status: "404",
+		},
+		{
+			name:   "Implicit 200",
+			path:   "/api/orders",
+			route:  "/api/orders",
+			status: "200",
+		},
+		{
+			name:   "Unknown path",
+			path:   "/wp-login.php",
+			route:  unmatchedRoute,
+			status: "404",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+			series := fmt.Sprintf(`gophermart_http_request_duration_seconds_count{method="GET",route="%s",status="%s"} 1`, tt.route, tt.status)
+			assert.Contains(t, scrape(t, m), series)
+		})
+	}
+	assert.Equal(t, 3, testutil.CollectAndCount(m.httpDuration))
+}
+
+func TestMetrics_ObserveStatement(t *testing.T) {
+	m := New()
+	m.ObserveStatement("SelectOrder", time.Millisecond, nil)
+	m.ObserveStatement("SelectOrder", time.Millisecond, sql.ErrNoRows)
+	m.ObserveStatement("SelectOrder", time.Millisecond, errors.New("connection refused"))
+
+	problems, err := testutil.GatherAndLint(m.Registry)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	body := scrape(t, m)
+	assert.Contains(t, body, `gophermart_storage_statement_duration_seconds_count{result="ok",statement="SelectOrder"} 2`)
+	assert.Contains(t, body, `gophermart_storage_statement_duration_seconds_count{result="error",statement="SelectOrder"} 1`)
+}
+
+func TestMetrics_Handler(t *testing.T) {
+	m := New()
+	m.ObserveAccrual(http.StatusTooManyRequests, time.Millisecond)
+	m.ObserveAccrual(0, time.Millisecond)
+	m.ObserveTick(time.Millisecond, 7)
+	m.ObserveReconcile(2)
+	require.NoError(t, m.RegisterGauge("auth_cache", "sessions", "Sessions stored in memory Auth Cache.", func() float64 { return 3 }))
+
+	body := scrape(t, m)
+	assert.Contains(t, body, `gophermart_accrual_requests_total{code="429"} 1`)
+	assert.Contains(t, body, `gophermart_accrual_requests_total{code="0"} 1`)
+	assert.Contains(t, body, `gophermart_accrual_cron_undone_orders 7`)
+	assert.Contains(t, body, `gophermart_ledger_balance_mismatches 2`)
+	assert.Contains(t, body, `gophermart_auth_cache_sessions 3`)
+	assert.Contains(t, body, `go_goroutines`)
+}
+
+// scrape returns metrics as Prometheus gets them
+func scrape(t *testing.T, m *Metrics) string {
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	return w.Body.String()
+}
@@ -0,0 +1,97 @@
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Number of Money units in one point
+const scale = 100
+
+// Money is an exact amount of loyalty points kept as integer hundredths (kopecks).
+// It is rendered as decimal number both in JSON and in database, e.g. 729.98
+type Money int64
+
+// FromFloat converts float amount to Money rounding to nearest hundredth
+func FromFloat(f float64) Money {
+	return Money(math.Round(f * scale))
+}
+
+// Parse converts decimal string to Money rounding to nearest hundredth
+func Parse(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.New("money: empty value")
+	}
+
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("money: can't parse %q", s)
+	}
+	r.Mul(r, big.NewRat(scale, 1))
+
+	// Round half away from zero
+	num := new(big.Int).Abs(r.Num())
+	den := r.Denom()
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Mul(rem, big.NewInt(2)).Cmp(den) >= 0 {
+		quo.Add(quo, big.NewInt(1))
+	}
+	if !quo.IsInt64() {
+		return 0, fmt.Errorf("money: value %q out of range", s)
+	}
+
+	m := Money(quo.Int64())
+	if r.Sign() < 0 {
+		m = -m
+	}
+	return m, nil
+}
+
+// Float64 returns approximate float value of amount
+func (m Money) Float64() float64 {
+	return float64(m) / scale
+}
+
+// String renders amount as decimal without trailing zeros: 729.98, 729.9, 500
+func (m Money) String() string {
+	sign := ""
+	v := int64(m)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+
+	whole := strconv.FormatInt(v/scale, 10)
+	frac := v % scale
+	if frac == 0 {
+		return sign + whole
+	}
+	return sign + whole + "." + strings.TrimRight(fmt.Sprintf("%02d", frac), "0")
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	v, err := Parse(string(data))
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// Value passes amount to database as numeric literal
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
@@ -0,0 +1,72 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    Money
+		wantErr bool
+	}{
+		{name: "Integer", value: "500", want: 50000},
+		{name: "Two decimals", value: "729.98", want: 72998},
+		{name: "Numeric from database", value: "0.10", want: 10},
+		{name: "Exponent", value: "1e2", want: 10000},
+		{name: "Round half up", value: "0.005", want: 1},
+		{name: "Negative", value: "-12.5", want: -1250},
+		{name: "Not a number", value: "NaN", wantErr: true},
+		{name: "Empty", value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMoney_String(t *testing.T) {
+	tests := []struct {
+		value Money
+		want  string
+	}{
+		{value: 72998, want: "729.98"},
+		{value: 72990, want: "729.9"},
+		{value: 50000, want: "500"},
+		{value: 5, want: "0.05"},
+		{value: -1250, want: "-12.5"},
+		{value: 0, want: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.value.String())
+		})
+	}
+}
+
+func TestMoney_JSON(t *testing.T) {
+	type balance struct {
+		Current Money `json:"current"`
+	}
+
+	var b balance
+	err := json.Unmarshal([]byte(`{"current": 0.1}`), &b)
+	assert.NoError(t, err)
+	b.Current += FromFloat(0.2)
+	assert.Equal(t, Money(30), b.Current)
+
+	data, err := json.Marshal(balance{Current: 72998})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"current": 729.98}`, string(data))
+}
@@ -0,0 +1,375 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"aprokhorov-diploma-1/internal/money"
+)
+
+// ledgerEntry is one posting of Memory ledger, the same as Ledger table row
+type ledgerEntry struct {
+	debit  string
+	credit string
+	amount money.Money
+	kind   string
+	order  string
+}
+
+// Memory is thread-safe in-memory Storage with the same semantics as Postgres.
+// Data lives only while process runs, so it is meant for tests and local development.
+type Memory struct {
+	mutex       *sync.RWMutex
+	users       map[string]User
+	orders      map[string]Order
+	balances    map[string]Balance
+	withdrawals map[string]Withdraw
+	ledger      []ledgerEntry
+	// Token versions of users, missed one is 0
+	tokenVersions map[string]int64
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		mutex:         &sync.RWMutex{},
+		users:         make(map[string]User),
+		orders:        make(map[string]Order),
+		balances:      make(map[string]Balance),
+		withdrawals:   make(map[string]Withdraw),
+		tokenVersions: make(map[string]int64),
+	}
+}
+
+func (m *Memory) GracefulShutdown() {}
+
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *Memory) RegisterUser(ctx context.Context, login string, hash string, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// Logins are unique case-insensitively, the same as users_login_lower index
+	for existing := range m.users {
+		if strings.EqualFold(existing, login) {
+			return ErrUserExists
+		}
+	}
+	m.users[login] = User{Login: login, PassHash: hash, Key: key, LastLogin: time.Now()}
+	return nil
+}
+
+func (m *Memory) GetUser(ctx context.Context, login string) (User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if user, exist := m.users[login]; exist {
+		return user, nil
+	}
+	for existing, user := range m.users {
+		if strings.EqualFold(existing, login) {
+			return user, nil
+		}
+	}
+	return User{}, sql.ErrNoRows
+}
+
+func (m *Memory) UpdatePassword(ctx context.Context, login string, hash string, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	user, exist := m.users[login]
+	if !exist {
+		return sql.ErrNoRows
+	}
+	user.PassHash = hash
+	user.Key = key
+	m.users[login] = user
+	return nil
+}
+
+func (m *Memory) DeleteUser(ctx context.Context, login string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exist := m.users[login]; !exist {
+		return sql.ErrNoRows
+	}
+	for _, o := range m.orders {
+		if o.Login == login && o.Status != StatusInvalid && o.Status != StatusProcessed {
+			return ErrOrdersInProgress
+		}
+	}
+
+	anonymous, err := anonymousLogin()
+	if err != nil {
+		return err
+	}
+	for id, o := range m.orders {
+		if o.Login == login {
+			o.Login = anonymous
+			m.orders[id] = o
+		}
+	}
+	for id, w := range m.withdrawals {
+		if w.Login == login {
+			w.Login = anonymous
+			m.withdrawals[id] = w
+		}
+	}
+	for i, entry := range m.ledger {
+		if entry.debit == UserAccount(login) {
+			m.ledger[i].debit = UserAccount(anonymous)
+		}
+		if entry.credit == UserAccount(login) {
+			m.ledger[i].credit = UserAccount(anonymous)
+		}
+	}
+	delete(m.balances, login)
+	delete(m.users, login)
+	delete(m.tokenVersions, login)
+	return nil
+}
+
+func (m *Memory) GetUsers(ctx context.Context) ([]*User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	users := make([]*User, 0, len(m.users))
+	for _, user := range m.users {
+		user := user
+		users = append(users, &user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Login < users[j].Login })
+	return users, nil
+}
+
+func (m *Memory) GetTokenVersion(ctx context.Context, login string) (int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if _, exist := m.users[login]; !exist {
+		return 0, sql.ErrNoRows
+	}
+	return m.tokenVersions[login], nil
+}
+
+func (m *Memory) BumpTokenVersion(ctx context.Context, login string) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exist := m.users[login]; !exist {
+		return 0, sql.ErrNoRows
+	}
+	m.tokenVersions[login]++
+	return m.tokenVersions[login], nil
+}
+
+func (m *Memory) AddOrder(ctx context.Context, login string, order string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exist := m.orders[order]; exist {
+		return ErrOrderExists
+	}
+	now := JSONTime(time.Now())
+	m.orders[order] = Order{OrderID: order, Login: login, Status: StatusNew, LastChange: now, UploadedAt: now}
+	return nil
+}
+
+func (m *Memory) ModifyOrder(ctx context.Context, order string, status string, score money.Money) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	o, exist := m.orders[order]
+	if !exist {
+		return nil
+	}
+	o.Status = status
+	o.Score = score
+	o.LastChange = JSONTime(time.Now())
+	m.orders[order] = o
+	return nil
+}
+
+func (m *Memory) AddOrderAttempt(ctx context.Context, order string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	o, exist := m.orders[order]
+	if !exist {
+		return nil
+	}
+	o.Attempts++
+	m.orders[order] = o
+	return nil
+}
+
+// ApplyAccrual behaves like Postgres.ApplyAccrual: final statuses are never changed
+// and balance is credited only on first transition into PROCESSED
+func (m *Memory) ApplyAccrual(ctx context.Context, order string, status string, score money.Money) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	o, exist := m.orders[order]
+	if !exist {
+		return sql.ErrNoRows
+	}
+
+	if o.Status == StatusProcessed || o.Status == StatusInvalid {
+		return nil
+	}
+
+	if status == StatusProcessed && score > 0 {
+		balance, exist := m.balances[o.Login]
+		if !exist {
+			return sql.ErrNoRows
+		}
+		balance.CurrentScore += score
+		m.balances[o.Login] = balance
+		m.ledger = append(m.ledger, ledgerEntry{debit: AccountAccrual, credit: UserAccount(o.Login), amount: score, kind: LedgerAccrual, order: order})
+	}
+
+	o.Status = status
+	o.Score = score
+	o.LastChange = JSONTime(time.Now())
+	m.orders[order] = o
+	return nil
+}
+
+func (m *Memory) GetOrder(ctx context.Context, order string) (Order, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	o, exist := m.orders[order]
+	if !exist {
+		return Order{}, sql.ErrNoRows
+	}
+	return o, nil
+}
+
+func (m *Memory) GetOrdersByUser(ctx context.Context, login string) ([]*Order, error) {
+	return m.selectOrders(func(o Order) bool { return o.Login == login }), nil
+}
+
+func (m *Memory) GetOrdersUndone(ctx context.Context) ([]*Order, error) {
+	return m.selectOrders(func(o Order) bool { return o.Status != StatusInvalid && o.Status != StatusProcessed }), nil
+}
+
+func (m *Memory) selectOrders(match func(o Order) bool) []*Order {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	orders := make([]*Order, 0)
+	for _, o := range m.orders {
+		if match(o) {
+			o := o
+			orders = append(orders, &o)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return time.Time(orders[i].UploadedAt).Before(time.Time(orders[j].UploadedAt))
+	})
+	return orders
+}
+
+func (m *Memory) AddBalance(ctx context.Context, login string, score money.Money, wd money.Money) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exist := m.balances[login]; exist {
+		return ErrBalanceExists
+	}
+	m.balances[login] = Balance{Login: login, CurrentScore: score, TotalWithdrawals: wd}
+	return nil
+}
+
+func (m *Memory) AdjustBalance(ctx context.Context, login string, amount money.Money) error {
+	if amount == 0 {
+		return nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	balance, exist := m.balances[login]
+	if !exist {
+		return sql.ErrNoRows
+	}
+	balance.CurrentScore += amount
+	m.balances[login] = balance
+
+	debit, credit := AccountAdjustments, UserAccount(login)
+	if amount < 0 {
+		debit, credit, amount = credit, debit, -amount
+	}
+	m.ledger = append(m.ledger, ledgerEntry{debit: debit, credit: credit, amount: amount, kind: LedgerAdjustment})
+	return nil
+}
+
+func (m *Memory) GetBalance(ctx context.Context, login string) (Balance, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	balance, exist := m.balances[login]
+	if !exist {
+		return Balance{}, sql.ErrNoRows
+	}
+	return balance, nil
+}
+
+// Withdraw behaves like Postgres.Withdraw: nothing is changed on insufficient funds or duplicated order
+func (m *Memory) Withdraw(ctx context.Context, login string, order string, wd money.Money) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	balance, exist := m.balances[login]
+	if !exist || balance.CurrentScore < wd {
+		return ErrInsufficientFunds
+	}
+	if _, exist := m.withdrawals[order]; exist {
+		return ErrWithdrawExists
+	}
+
+	balance.CurrentScore -= wd
+	balance.TotalWithdrawals += wd
+	m.balances[login] = balance
+	m.withdrawals[order] = Withdraw{OrderID: order, Login: login, Withdraw: wd, Time: JSONTime(time.Now())}
+	m.ledger = append(m.ledger, ledgerEntry{debit: UserAccount(login), credit: AccountWithdrawals, amount: wd, kind: LedgerWithdraw, order: order})
+	return nil
+}
+
+func (m *Memory) GetWithdrawals(ctx context.Context, login string) ([]*Withdraw, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	withdrawals := make([]*Withdraw, 0)
+	for _, w := range m.withdrawals {
+		if w.Login == login {
+			w := w
+			withdrawals = append(withdrawals, &w)
+		}
+	}
+	sort.Slice(withdrawals, func(i, j int) bool {
+		return time.Time(withdrawals[i].Time).Before(time.Time(withdrawals[j].Time))
+	})
+	return withdrawals, nil
+}
+
+func (m *Memory) ReconcileBalances(ctx context.Context) ([]*BalanceMismatch, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	scores := make(map[string]money.Money)
+	withdrawals := make(map[string]money.Money)
+	for _, entry := range m.ledger {
+		scores[entry.credit] += entry.amount
+		scores[entry.debit] -= entry.amount
+		if entry.kind == LedgerWithdraw {
+			withdrawals[entry.debit] += entry.amount
+		}
+	}
+
+	mismatches := make([]*BalanceMismatch, 0)
+	for login, balance := range m.balances {
+		account := UserAccount(login)
+		if balance.CurrentScore != scores[account] || balance.TotalWithdrawals != withdrawals[account] {
+			mismatches = append(mismatches, &BalanceMismatch{
+				Login:                  login,
+				CurrentScore:           balance.CurrentScore,
+				TotalWithdrawals:       balance.TotalWithdrawals,
+				LedgerScore:            scores[account],
+				LedgerTotalWithdrawals: withdrawals[account],
+			})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Login < mismatches[j].Login })
+	return mismatches, nil
+}
@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// Key of Postgres advisory lock held while migrating,
+// so two gophermart instances never migrate concurrently
+const migrationLockID int64 = 5_463_210_879
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one versioned schema change with its rollback
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migrationChecks are run before migration of the same version, they report data migration would fail on
+var migrationChecks = map[int]func(ctx context.Context, conn *sql.Conn) error{
+	9: checkLoginDuplicates,
+}
+
+// MigrationState is a migration with time it was applied, zero if not applied yet
+type MigrationState struct {
+	Migration
+	AppliedAt time.Time
+}
+
+// loadMigrations reads "<version>_<name>.<up|down>.sql" files ordered by version
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		name := file[len("migrations/"):]
+		match := migrationFile.FindStringSubmatch(name)
+		if match == nil {
+			return nil, fmt.Errorf("migrations: bad file name %s", name)
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, exist := byVersion[version]
+		if !exist {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migrations: version %d has different names %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migrations: version %d has no up migration", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Migrate applies all pending migrations
+func Migrate(ctx context.Context, db *sql.DB) error {
+	return withMigrationLock(ctx, db, func(conn *sql.Conn, migrations []Migration, applied map[int]time.Time) error {
+		for _, m := range migrations {
+			if _, done := applied[m.Version]; done {
+				continue
+			}
+			if err := checkMigration(ctx, conn, m); err != nil {
+				return err
+			}
+			err := runMigration(ctx, conn, m.Up, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)", m.Version, m.Name, time.Now())
+			if err != nil {
+				return fmt.Errorf("migrations: up %d_%s: %w", m.Version, m.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// CheckMigrations runs checks of all pending migrations without applying them
+func CheckMigrations(ctx context.Context, db *sql.DB) error {
+	return withMigrationLock(ctx, db, func(conn *sql.Conn, migrations []Migration, applied map[int]time.Time) error {
+		var errs []string
+		for _, m := range migrations {
+			if _, done := applied[m.Version]; done {
+				continue
+			}
+			if err := checkMigration(ctx, conn, m); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if len(errs) > 0 {
+			return errors.New(strings.Join(errs, "\n"))
+		}
+		return nil
+	})
+}
+
+// MigrateDown rolls back last steps applied migrations
+func MigrateDown(ctx context.Context, db *sql.DB, steps int) error {
+	return withMigrationLock(ctx, db, func(conn *sql.Conn, migrations []Migration, applied map[int]time.Time) error {
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			m := migrations[i]
+			if _, done := applied[m.Version]; !done {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migrations: version %d has no down migration", m.Version)
+			}
+			err := runMigration(ctx, conn, m.Down, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+			if err != nil {
+				return fmt.Errorf("migrations: down %d_%s: %w", m.Version, m.Name, err)
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// MigrationStatus lists all known migrations with time they have been applied
+func MigrationStatus(ctx context.Context, db *sql.DB) ([]MigrationState, error) {
+	var states []MigrationState
+	err := withMigrationLock(ctx, db, func(conn *sql.Conn, migrations []Migration, applied map[int]time.Time) error {
+		for _, m := range migrations {
+			states = append(states, MigrationState{Migration: m, AppliedAt: applied[m.Version]})
+		}
+		return nil
+	})
+	return states, err
+}
+
+// withMigrationLock holds advisory lock on one connection and passes known and applied migrations to fn
+func withMigrationLock(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn, migrations []Migration, applied map[int]time.Time) error) error {
+	migrations, err := loadMigrations(migrationsFS)
+	if err != nil {
+		return err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	_, err = conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version bigint PRIMARY KEY, name text NOT NULL, applied_at timestamp NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn, migrations, applied)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func checkMigration(ctx context.Context, conn *sql.Conn, m Migration) error {
+	check, exist := migrationChecks[m.Version]
+	if !exist {
+		return nil
+	}
+	if err := check(ctx, conn); err != nil {
+		return fmt.Errorf("migrations: check %d_%s: %w", m.Version, m.Name, err)
+	}
+	return nil
+}
+
+// checkLoginDuplicates reports logins differing only in case, they must be renamed or deleted
+// before users_login_lower unique index is created
+func checkLoginDuplicates(ctx context.Context, conn *sql.Conn) error {
+	rows, err := conn.QueryContext(ctx, "SELECT string_agg(login, ', ' ORDER BY login) FROM Users GROUP BY lower(login) HAVING count(*) > 1 ORDER BY lower(login)")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var duplicates []string
+	for rows.Next() {
+		var logins string
+		if err := rows.Scan(&logins); err != nil {
+			return err
+		}
+		duplicates = append(duplicates, "["+logins+"]")
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("logins differ only in case, rename or delete them first: %s", strings.Join(duplicates, ", "))
+	}
+	return nil
+}
+
+// runMigration executes migration script and records it in schema_migrations in one transaction
+func runMigration(ctx context.Context, conn *sql.Conn, script string, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, record, args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
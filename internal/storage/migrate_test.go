@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		want    []Migration
+		wantErr bool
+	}{
+		{
+			name: "Ordered by version",
+			files: fstest.MapFS{
+				"migrations/0010_second.up.sql":  {Data: []byte("second up")},
+				"migrations/0002_first.up.sql":   {Data: []byte("first up")},
+				"migrations/0002_first.down.sql": {Data: []byte("first down")},
+			},
+			want: []Migration{
+				{Version: 2, Name: "first", Up: "first up", Down: "first down"},
+				{Version: 10, Name: "second", Up: "second up"},
+			},
+		},
+		{
+			name: "Bad file name",
+			files: fstest.MapFS{
+				"migrations/first.up.sql": {Data: []byte("first up")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Down without up",
+			files: fstest.MapFS{
+				"migrations/0001_first.down.sql": {Data: []byte("first down")},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, migrations)
+		})
+	}
+}
+
+func TestLoadMigrations_Embedded(t *testing.T) {
+	migrations, err := loadMigrations(migrationsFS)
+	assert.NoError(t, err)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version, "migration versions must have no gaps")
+		assert.NotEmpty(t, m.Down, "migration %d has no down script", m.Version)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	migrations, err := loadMigrations(migrationsFS)
+	assert.NoError(t, err)
+
+	// First two migrations have been applied already
+	mock.ExpectExec(`SELECT pg_advisory_lock\(\$1\)`).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version, applied_at FROM schema_migrations`).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).
+			AddRow(1, time.Now()).
+			AddRow(2, time.Now()))
+	for _, m := range migrations[2:] {
+		if m.Version == 9 {
+			mock.ExpectQuery(`SELECT string_agg\(login, ', ' ORDER BY login\) FROM Users GROUP BY lower\(login\)`).
+				WillReturnRows(sqlmock.NewRows([]string{"string_agg"}))
+		}
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(m.Up)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`INSERT INTO schema_migrations \(version, name, applied_at\) VALUES \(\$1, \$2, \$3\)`).
+			WithArgs(m.Version, m.Name, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err = Migrate(context.Background(), db)
+	assert.NoError(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+func TestMigrate_LoginDuplicates(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"version", "applied_at"})
+	for version := 1; version <= 8; version++ {
+		rows.AddRow(version, time.Now())
+	}
+
+	// Index is not created, duplicates are reported instead
+	mock.ExpectExec(`SELECT pg_advisory_lock\(\$1\)`).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version, applied_at FROM schema_migrations`).WillReturnRows(rows)
+	mock.ExpectQuery(`SELECT string_agg\(login, ', ' ORDER BY login\) FROM Users GROUP BY lower\(login\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"string_agg"}).
+			AddRow("User1, user1").
+			AddRow("BOB, Bob, bob"))
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err = Migrate(context.Background(), db)
+	assert.EqualError(t, err, "migrations: check 9_users_login_lower: logins differ only in case, rename or delete them first: [User1, user1], [BOB, Bob, bob]")
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+func TestMigrateDown(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	migrations, err := loadMigrations(migrationsFS)
+	assert.NoError(t, err)
+
+	rows := sqlmock.NewRows([]string{"version", "applied_at"})
+	for _, m := range migrations {
+		rows.AddRow(m.Version, time.Now())
+	}
+	last := migrations[len(migrations)-1]
+
+	mock.ExpectExec(`SELECT pg_advisory_lock\(\$1\)`).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version, applied_at FROM schema_migrations`).WillReturnRows(rows)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(last.Down)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM schema_migrations WHERE version = \$1`).
+		WithArgs(last.Version).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err = MigrateDown(context.Background(), db, 1)
+	assert.NoError(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
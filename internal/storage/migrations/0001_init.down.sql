@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS Withdrawals;
+DROP TABLE IF EXISTS Orders;
+DROP TABLE IF EXISTS Balance;
+DROP TABLE IF EXISTS Users;
@@ -0,0 +1 @@
+ALTER TABLE Orders ADD COLUMN IF NOT EXISTS attempts integer NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+ALTER TABLE Balance ALTER COLUMN cur_score TYPE double precision, ALTER COLUMN total_wd TYPE double precision;
+ALTER TABLE Orders ALTER COLUMN score TYPE double precision;
+ALTER TABLE Withdrawals ALTER COLUMN wd TYPE double precision;
@@ -0,0 +1,3 @@
+ALTER TABLE Balance ALTER COLUMN cur_score TYPE numeric(18,2), ALTER COLUMN total_wd TYPE numeric(18,2);
+ALTER TABLE Orders ALTER COLUMN score TYPE numeric(18,2);
+ALTER TABLE Withdrawals ALTER COLUMN wd TYPE numeric(18,2);
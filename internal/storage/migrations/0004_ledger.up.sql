@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS Ledger (
+    id bigserial PRIMARY KEY,
+    debit text NOT NULL,
+    credit text NOT NULL,
+    amount numeric(18,2) NOT NULL CHECK (amount > 0),
+    kind text NOT NULL,
+    order_id bigint,
+    created_at timestamp NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS ledger_kind_order ON Ledger (kind, order_id) WHERE order_id IS NOT NULL;
+
+-- Backfill operations made before Ledger appeared
+INSERT INTO Ledger (debit, credit, amount, kind, order_id, created_at)
+    SELECT 'system:accrual', 'user:' || o.login, o.score, 'ACCRUAL', o.order_id, o.last_changed FROM Orders o
+    WHERE o.status = 'PROCESSED' AND o.score > 0
+    ON CONFLICT DO NOTHING;
+
+INSERT INTO Ledger (debit, credit, amount, kind, order_id, created_at)
+    SELECT 'user:' || w.login, 'system:withdrawals', w.wd, 'WITHDRAW', w.order_id, w.time FROM Withdrawals w
+    WHERE w.wd > 0
+    ON CONFLICT DO NOTHING;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS withdrawals_login;
+DROP INDEX IF EXISTS orders_undone;
+DROP INDEX IF EXISTS orders_login;
@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS orders_login ON Orders (login);
+CREATE INDEX IF NOT EXISTS orders_undone ON Orders (status) WHERE status != 'INVALID' AND status != 'PROCESSED';
+CREATE INDEX IF NOT EXISTS withdrawals_login ON Withdrawals (login);
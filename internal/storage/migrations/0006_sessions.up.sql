@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS Sessions (
+    token_hash text PRIMARY KEY,
+    login text NOT NULL,
+    last_active timestamp NOT NULL,
+    expires_at timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sessions_expires_at ON Sessions (expires_at);
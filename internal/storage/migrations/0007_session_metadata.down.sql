@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS sessions_login;
+
+ALTER TABLE Sessions
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS user_agent,
+    DROP COLUMN IF EXISTS ip;
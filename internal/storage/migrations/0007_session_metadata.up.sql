@@ -0,0 +1,6 @@
+ALTER TABLE Sessions
+    ADD COLUMN IF NOT EXISTS created_at timestamp NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS sessions_login ON Sessions (login);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS LoginFailures (
+    key text PRIMARY KEY,
+    failures integer NOT NULL,
+    last_failure timestamp NOT NULL,
+    locked_until timestamp
+);
+
+CREATE INDEX IF NOT EXISTS login_failures_last_failure ON LoginFailures (last_failure);
@@ -0,0 +1,3 @@
+-- Logins differing only in case are the same user. Index can't be created while such duplicates exist,
+-- they are reported before migration and by "gophermart migrate check"
+CREATE UNIQUE INDEX IF NOT EXISTS users_login_lower ON Users (lower(login));
@@ -0,0 +1,2 @@
+-- Signed auth tokens carry version, bumping it revokes every token of user
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS token_version bigint NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE LoginFailures DROP COLUMN IF EXISTS lockouts;
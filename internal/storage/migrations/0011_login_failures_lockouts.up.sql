@@ -0,0 +1,2 @@
+-- Number of lockouts in a row, every next lockout is twice longer
+ALTER TABLE LoginFailures ADD COLUMN IF NOT EXISTS lockouts integer NOT NULL DEFAULT 0;
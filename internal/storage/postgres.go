@@ -8,32 +8,56 @@ import (
 	"sync"
 	"time"
 
+	"aprokhorov-diploma-1/internal/money"
+
+	"github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
 
+// Postgres error code for unique constraint violation
+const pgUniqueViolation = "23505"
+
 type Postgres struct {
 	DB         *sql.DB
 	mutex      *sync.RWMutex
 	Statements Statements
+	// Observer gets duration of every statement execution, optional
+	Observer StatementObserver
 }
 
 type Statements struct {
 	InsertUser         *sql.Stmt
 	SelectUser         *sql.Stmt
 	SelectUsers        *sql.Stmt
+	UpdateUserPassword *sql.Stmt
 	InsertOrder        *sql.Stmt
 	UpdateOrder        *sql.Stmt
+	UpdateOrderAttempt *sql.Stmt
+	SelectOrderLock    *sql.Stmt
 	SelectOrder        *sql.Stmt
 	SelectOrdersByUser *sql.Stmt
 	SelectOrdersUndone *sql.Stmt
 	InsertBalance      *sql.Stmt
-	UpdateBalance      *sql.Stmt
+	IncreaseBalance    *sql.Stmt
+	DecreaseBalance    *sql.Stmt
 	SelectBalance      *sql.Stmt
 	InsertWithdraw     *sql.Stmt
 	SelectWithdrawals  *sql.Stmt
+	InsertLedger       *sql.Stmt
+	SelectMismatches   *sql.Stmt
+	SelectUserLock     *sql.Stmt
+	CountOrdersUndone  *sql.Stmt
+	AnonymizeOrders    *sql.Stmt
+	AnonymizeWithdraws *sql.Stmt
+	AnonymizeLedger    *sql.Stmt
+	DeleteBalance      *sql.Stmt
+	DeleteUser         *sql.Stmt
+	SelectTokenVersion *sql.Stmt
+	UpdateTokenVersion *sql.Stmt
 }
 
-func NewPostgresClient(ctx context.Context, address string, dbname string) (Postgres, error) {
+// OpenPostgres connects to database without touching its schema
+func OpenPostgres(address string, dbname string) (*sql.DB, error) {
 	dbName := ""
 	if dbname != "" {
 		dbName = fmt.Sprintf("/%s", dbname)
@@ -42,20 +66,29 @@ func NewPostgresClient(ctx context.Context, address string, dbname string) (Post
 
 	// Сравнить значение err с ошибкой sql Database NOT Exist
 	if err != nil {
-		return Postgres{}, err
+		return nil, err
 	}
 
 	db.SetMaxIdleConns(10)
 	db.SetMaxOpenConns(10)
 	db.SetConnMaxIdleTime(10)
 
+	return db, nil
+}
+
+func NewPostgresClient(ctx context.Context, address string, dbname string) (Postgres, error) {
+	db, err := OpenPostgres(address, dbname)
+	if err != nil {
+		return Postgres{}, err
+	}
+
 	newPGS := Postgres{
 		DB:         db,
 		mutex:      &sync.RWMutex{},
 		Statements: Statements{},
 	}
 
-	err = newPGS.InitTables(ctx)
+	err = Migrate(ctx, db)
 	if err != nil {
 		return Postgres{}, err
 	}
@@ -68,70 +101,46 @@ func NewPostgresClient(ctx context.Context, address string, dbname string) (Post
 	return newPGS, nil
 }
 
+func (p Postgres) Ping(ctx context.Context) error {
+	return p.DB.PingContext(ctx)
+}
+
 func (p *Postgres) GracefulShutdown() {
 	// Close Statements
 
 	p.Statements.InsertUser.Close()
 	p.Statements.SelectUser.Close()
 	p.Statements.SelectUsers.Close()
+	p.Statements.UpdateUserPassword.Close()
 	p.Statements.InsertOrder.Close()
 	p.Statements.UpdateOrder.Close()
+	p.Statements.UpdateOrderAttempt.Close()
+	p.Statements.SelectOrderLock.Close()
 	p.Statements.SelectOrder.Close()
 	p.Statements.SelectOrdersByUser.Close()
 	p.Statements.SelectOrdersUndone.Close()
 	p.Statements.InsertBalance.Close()
-	p.Statements.UpdateBalance.Close()
+	p.Statements.IncreaseBalance.Close()
+	p.Statements.DecreaseBalance.Close()
 	p.Statements.SelectBalance.Close()
 	p.Statements.InsertWithdraw.Close()
 	p.Statements.SelectWithdrawals.Close()
+	p.Statements.InsertLedger.Close()
+	p.Statements.SelectMismatches.Close()
+	p.Statements.SelectUserLock.Close()
+	p.Statements.CountOrdersUndone.Close()
+	p.Statements.AnonymizeOrders.Close()
+	p.Statements.AnonymizeWithdraws.Close()
+	p.Statements.AnonymizeLedger.Close()
+	p.Statements.DeleteBalance.Close()
+	p.Statements.DeleteUser.Close()
+	p.Statements.SelectTokenVersion.Close()
+	p.Statements.UpdateTokenVersion.Close()
 
 	// Close DB
 	p.DB.Close()
 }
 
-func (p *Postgres) InitTables(ctx context.Context) error {
-	scheme := []string{
-		`Users (
-			login text PRIMARY KEY,
-			pass_hash text NOT NULL,
-			key text NOT NULL,
-			last_login timestamp NOT NULL
-			)`,
-
-		`Balance (
-			login text PRIMARY KEY,
-			cur_score double precision NOT NULL,
-			total_wd double precision NOT NULL
-			)`,
-
-		`Orders (
-			order_id bigint PRIMARY KEY,
-			login text NOT NULL,
-			status text NOT NULL,
-			score double precision NOT NULL,
-			created_at timestamp NOT NULL,
-			last_changed timestamp NOT NULL
-			)`,
-
-		`Withdrawals (
-			order_id bigint PRIMARY KEY,
-			login text NOT NULL,
-			wd double precision NOT NULL,
-			time timestamp NOT NULL
-			)`,
-	}
-
-	for _, table := range scheme {
-		query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s", table)
-		_, err := p.DB.ExecContext(ctx, query)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 func (p *Postgres) PrepareStatements(ctx context.Context) error {
 	stmt, err := p.DB.PrepareContext(ctx, "INSERT INTO Users (login, pass_hash, key, last_login) VALUES ($1, $2, $3, $4)")
 	if err != nil {
@@ -139,7 +148,7 @@ func (p *Postgres) PrepareStatements(ctx context.Context) error {
 	}
 	p.Statements.InsertUser = stmt
 
-	stmt, err = p.DB.PrepareContext(ctx, "SELECT login, pass_hash, key, last_login FROM Users WHERE login = $1")
+	stmt, err = p.DB.PrepareContext(ctx, "SELECT login, pass_hash, key, last_login FROM Users WHERE lower(login) = lower($1)")
 	if err != nil {
 		return err
 	}
@@ -151,6 +160,12 @@ func (p *Postgres) PrepareStatements(ctx context.Context) error {
 	}
 	p.Statements.SelectUsers = stmt
 
+	stmt, err = p.DB.PrepareContext(ctx, "UPDATE Users SET pass_hash = $2, key = $3 WHERE login = $1")
+	if err != nil {
+		return err
+	}
+	p.Statements.UpdateUserPassword = stmt
+
 	stmt, err = p.DB.PrepareContext(ctx, "INSERT INTO Orders (order_id, login, status, score, created_at, last_changed) VALUES ($1, $2, $3, $4, $5, $6)")
 	if err != nil {
 		return err
@@ -163,19 +178,31 @@ func (p *Postgres) PrepareStatements(ctx context.Context) error {
 	}
 	p.Statements.UpdateOrder = stmt
 
-	stmt, err = p.DB.PrepareContext(ctx, "SELECT order_id, login, status, score, last_changed, created_at FROM Orders WHERE order_id = $1")
+	stmt, err = p.DB.PrepareContext(ctx, "UPDATE Orders SET attempts = attempts + 1 WHERE order_id = $1")
+	if err != nil {
+		return err
+	}
+	p.Statements.UpdateOrderAttempt = stmt
+
+	stmt, err = p.DB.PrepareContext(ctx, "SELECT login, status FROM Orders WHERE order_id = $1 FOR UPDATE")
+	if err != nil {
+		return err
+	}
+	p.Statements.SelectOrderLock = stmt
+
+	stmt, err = p.DB.PrepareContext(ctx, "SELECT order_id, login, status, score, last_changed, created_at, attempts FROM Orders WHERE order_id = $1")
 	if err != nil {
 		return err
 	}
 	p.Statements.SelectOrder = stmt
 
-	stmt, err = p.DB.PrepareContext(ctx, "SELECT order_id, login, status, score, last_changed, created_at FROM Orders WHERE login = $1")
+	stmt, err = p.DB.PrepareContext(ctx, "SELECT order_id, login, status, score, last_changed, created_at, attempts FROM Orders WHERE login = $1")
 	if err != nil {
 		return err
 	}
 	p.Statements.SelectOrdersByUser = stmt
 
-	stmt, err = p.DB.PrepareContext(ctx, "SELECT order_id, login, status, score, last_changed, created_at FROM Orders WHERE status != 'INVALID' AND status != 'PROCESSED'")
+	stmt, err = p.DB.PrepareContext(ctx, "SELECT order_id, login, status, score, last_changed, created_at, attempts FROM Orders WHERE status != 'INVALID' AND status != 'PROCESSED'")
 	if err != nil {
 		return err
 	}
@@ -187,11 +214,17 @@ func (p *Postgres) PrepareStatements(ctx context.Context) error {
 	}
 	p.Statements.InsertBalance = stmt
 
-	stmt, err = p.DB.PrepareContext(ctx, "UPDATE Balance SET cur_score = $2, total_wd = $3 WHERE login = $1")
+	stmt, err = p.DB.PrepareContext(ctx, "UPDATE Balance SET cur_score = cur_score + $2 WHERE login = $1")
+	if err != nil {
+		return err
+	}
+	p.Statements.IncreaseBalance = stmt
+
+	stmt, err = p.DB.PrepareContext(ctx, "UPDATE Balance SET cur_score = cur_score - $2, total_wd = total_wd + $2 WHERE login = $1 AND cur_score >= $2")
 	if err != nil {
 		return err
 	}
-	p.Statements.UpdateBalance = stmt
+	p.Statements.DecreaseBalance = stmt
 
 	stmt, err = p.DB.PrepareContext(ctx, "SELECT login, cur_score, total_wd FROM Balance WHERE login = $1")
 	if err != nil {
@@ -211,20 +244,105 @@ func (p *Postgres) PrepareStatements(ctx context.Context) error {
 	}
 	p.Statements.SelectWithdrawals = stmt
 
+	stmt, err = p.DB.PrepareContext(ctx, "INSERT INTO Ledger (debit, credit, amount, kind, order_id, created_at) VALUES ($1, $2, $3, $4, $5, $6)")
+	if err != nil {
+		return err
+	}
+	p.Statements.InsertLedger = stmt
+
+	stmt, err = p.DB.PrepareContext(ctx, `WITH entries AS (
+			SELECT credit AS account, amount AS score, 0 AS wd FROM Ledger
+			UNION ALL
+			SELECT debit, -amount, CASE WHEN kind = 'WITHDRAW' THEN amount ELSE 0 END FROM Ledger
+		), sums AS (
+			SELECT account, SUM(score) AS score, SUM(wd) AS wd FROM entries GROUP BY account
+		)
+		SELECT b.login, b.cur_score, b.total_wd, COALESCE(s.score, 0), COALESCE(s.wd, 0)
+		FROM Balance b LEFT JOIN sums s ON s.account = 'user:' || b.login
+		WHERE b.cur_score != COALESCE(s.score, 0) OR b.total_wd != COALESCE(s.wd, 0)`)
+	if err != nil {
+		return err
+	}
+	p.Statements.SelectMismatches = stmt
+
+	stmt, err = p.DB.PrepareContext(ctx, "SELECT login FROM Users WHERE login = $1 FOR UPDATE")
+	if err != nil {
+		return err
+	}
+	p.Statements.SelectUserLock = stmt
+
+	stmt, err = p.DB.PrepareContext(ctx, "SELECT count(*) FROM Orders WHERE login = $1 AND status != 'INVALID' AND status != 'PROCESSED'")
+	if err != nil {
+		return err
+	}
+	p.Statements.CountOrdersUndone = stmt
+
+	stmt, err = p.DB.PrepareContext(ctx, "UPDATE Orders SET login = $2 WHERE login = $1")
+	if err != nil {
+		return err
+	}
+	p.Statements.AnonymizeOrders = stmt
+
+	stmt, err = p.DB.PrepareContext(ctx, "UPDATE Withdrawals SET login = $2 WHERE login = $1")
+	if err != nil {
+		return err
+	}
+	p.Statements.AnonymizeWithdraws = stmt
+
+	stmt, err = p.DB.PrepareContext(ctx, `UPDATE Ledger SET
+		debit = CASE WHEN debit = $1 THEN $2 ELSE debit END,
+		credit = CASE WHEN credit = $1 THEN $2 ELSE credit END
+		WHERE debit = $1 OR credit = $1`)
+	if err != nil {
+		return err
+	}
+	p.Statements.AnonymizeLedger = stmt
+
+	stmt, err = p.DB.PrepareContext(ctx, "DELETE FROM Balance WHERE login = $1")
+	if err != nil {
+		return err
+	}
+	p.Statements.DeleteBalance = stmt
+
+	stmt, err = p.DB.PrepareContext(ctx, "DELETE FROM Users WHERE login = $1")
+	if err != nil {
+		return err
+	}
+	p.Statements.DeleteUser = stmt
+
+	stmt, err = p.DB.PrepareContext(ctx, "SELECT token_version FROM Users WHERE login = $1")
+	if err != nil {
+		return err
+	}
+	p.Statements.SelectTokenVersion = stmt
+
+	stmt, err = p.DB.PrepareContext(ctx, "UPDATE Users SET token_version = token_version + 1 WHERE login = $1 RETURNING token_version")
+	if err != nil {
+		return err
+	}
+	p.Statements.UpdateTokenVersion = stmt
+
 	return nil
 }
 
 func (p Postgres) RegisterUser(ctx context.Context, login string, hash string, key string) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
+	start := time.Now()
 	_, err := p.Statements.InsertUser.ExecContext(ctx, login, hash, key, time.Now())
+	p.observe("InsertUser", start, err)
+	if isUniqueViolation(err) {
+		return ErrUserExists
+	}
 	return err
 }
 
 func (p Postgres) GetUser(ctx context.Context, login string) (User, error) {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
+	start := time.Now()
 	users, err := getBulk[*User](ctx, p.Statements.SelectUser, login)
+	p.observe("SelectUser", start, err)
 	if err != nil {
 		return User{}, err
 	}
@@ -240,28 +358,146 @@ func (p Postgres) GetUser(ctx context.Context, login string) (User, error) {
 func (p Postgres) GetUsers(ctx context.Context) ([]*User, error) {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
-	return getBulk[*User](ctx, p.Statements.SelectUsers)
+	start := time.Now()
+	result, err := getBulk[*User](ctx, p.Statements.SelectUsers)
+	p.observe("SelectUsers", start, err)
+	return result, err
+}
+
+func (p Postgres) UpdatePassword(ctx context.Context, login string, hash string, key string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	start := time.Now()
+	res, err := p.Statements.UpdateUserPassword.ExecContext(ctx, login, hash, key)
+	p.observe("UpdateUserPassword", start, err)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (p Postgres) GetTokenVersion(ctx context.Context, login string) (int64, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var version int64
+	start := time.Now()
+	err := p.Statements.SelectTokenVersion.QueryRowContext(ctx, login).Scan(&version)
+	p.observe("SelectTokenVersion", start, err)
+	return version, err
+}
+
+func (p Postgres) BumpTokenVersion(ctx context.Context, login string) (int64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var version int64
+	start := time.Now()
+	err := p.Statements.UpdateTokenVersion.QueryRowContext(ctx, login).Scan(&version)
+	p.observe("UpdateTokenVersion", start, err)
+	return version, err
 }
 
 func (p Postgres) AddOrder(ctx context.Context, login string, order string) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
+	start := time.Now()
 	time := time.Now()
-	_, err := p.Statements.InsertOrder.ExecContext(ctx, order, login, "NEW", 0, time, time)
+	_, err := p.Statements.InsertOrder.ExecContext(ctx, order, login, StatusNew, 0, time, time)
+	p.observe("InsertOrder", start, err)
+	if isUniqueViolation(err) {
+		return ErrOrderExists
+	}
 	return err
 }
 
-func (p Postgres) ModifyOrder(ctx context.Context, order string, status string, score float64) error {
+func (p Postgres) ModifyOrder(ctx context.Context, order string, status string, score money.Money) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
+	start := time.Now()
 	_, err := p.Statements.UpdateOrder.ExecContext(ctx, order, status, score, time.Now())
+	p.observe("UpdateOrder", start, err)
+	return err
+}
+
+// ApplyAccrual moves order to status got from accrual service and credits user balance
+// in one transaction. Balance is credited and accrual is booked in Ledger only on first
+// transition into PROCESSED, orders in final status are left untouched.
+func (p Postgres) ApplyAccrual(ctx context.Context, order string, status string, score money.Money) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var login, curStatus string
+	start := time.Now()
+	err = tx.StmtContext(ctx, p.Statements.SelectOrderLock).QueryRowContext(ctx, order).Scan(&login, &curStatus)
+	p.observe("SelectOrderLock", start, err)
+	if err != nil {
+		return err
+	}
+
+	if curStatus == StatusProcessed || curStatus == StatusInvalid {
+		return nil
+	}
+
+	start = time.Now()
+	_, err = tx.StmtContext(ctx, p.Statements.UpdateOrder).ExecContext(ctx, order, status, score, time.Now())
+	p.observe("UpdateOrder", start, err)
+	if err != nil {
+		return err
+	}
+
+	if status == StatusProcessed && score > 0 {
+		start = time.Now()
+		result, err := tx.StmtContext(ctx, p.Statements.IncreaseBalance).ExecContext(ctx, login, score)
+		p.observe("IncreaseBalance", start, err)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows != 1 {
+			return fmt.Errorf("PG: ApplyAccrual no balance for user %s", login)
+		}
+
+		start = time.Now()
+		_, err = tx.StmtContext(ctx, p.Statements.InsertLedger).ExecContext(ctx, AccountAccrual, UserAccount(login), score, LedgerAccrual, order, time.Now())
+		p.observe("InsertLedger", start, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (p Postgres) AddOrderAttempt(ctx context.Context, order string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	start := time.Now()
+	_, err := p.Statements.UpdateOrderAttempt.ExecContext(ctx, order)
+	p.observe("UpdateOrderAttempt", start, err)
 	return err
 }
 
 func (p Postgres) GetOrder(ctx context.Context, order string) (Order, error) {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
+	start := time.Now()
 	orders, err := getBulk[*Order](ctx, p.Statements.SelectOrder, order)
+	p.observe("SelectOrder", start, err)
 	if err != nil {
 		return Order{}, err
 	}
@@ -278,33 +514,83 @@ func (p Postgres) GetOrder(ctx context.Context, order string) (Order, error) {
 func (p Postgres) GetOrdersByUser(ctx context.Context, login string) ([]*Order, error) {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
-	return getBulk[*Order](ctx, p.Statements.SelectOrdersByUser, login)
+	start := time.Now()
+	result, err := getBulk[*Order](ctx, p.Statements.SelectOrdersByUser, login)
+	p.observe("SelectOrdersByUser", start, err)
+	return result, err
 }
 
 func (p Postgres) GetOrdersUndone(ctx context.Context) ([]*Order, error) {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
-	return getBulk[*Order](ctx, p.Statements.SelectOrdersUndone)
+	start := time.Now()
+	result, err := getBulk[*Order](ctx, p.Statements.SelectOrdersUndone)
+	p.observe("SelectOrdersUndone", start, err)
+	return result, err
 }
 
-func (p Postgres) AddBalance(ctx context.Context, login string, score float64, wd float64) error {
+func (p Postgres) AddBalance(ctx context.Context, login string, score money.Money, wd money.Money) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
+	start := time.Now()
 	_, err := p.Statements.InsertBalance.ExecContext(ctx, login, score, wd)
+	p.observe("InsertBalance", start, err)
+	if isUniqueViolation(err) {
+		return ErrBalanceExists
+	}
 	return err
 }
 
-func (p Postgres) ModifyBalance(ctx context.Context, login string, score float64, wd float64) error {
+// AdjustBalance manually changes user balance by amount (negative to debit)
+// and books adjustment in Ledger in one transaction
+func (p Postgres) AdjustBalance(ctx context.Context, login string, amount money.Money) error {
+	if amount == 0 {
+		return nil
+	}
+
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	_, err := p.Statements.UpdateBalance.ExecContext(ctx, login, score, wd)
-	return err
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	start := time.Now()
+	result, err := tx.StmtContext(ctx, p.Statements.IncreaseBalance).ExecContext(ctx, login, amount)
+	p.observe("IncreaseBalance", start, err)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	debit, credit := AccountAdjustments, UserAccount(login)
+	if amount < 0 {
+		debit, credit, amount = credit, debit, -amount
+	}
+	start = time.Now()
+	_, err = tx.StmtContext(ctx, p.Statements.InsertLedger).ExecContext(ctx, debit, credit, amount, LedgerAdjustment, nil, time.Now())
+	p.observe("InsertLedger", start, err)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (p Postgres) GetBalance(ctx context.Context, login string) (Balance, error) {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
+	start := time.Now()
 	balances, err := getBulk[*Balance](ctx, p.Statements.SelectBalance, login)
+	p.observe("SelectBalance", start, err)
 	if err != nil {
 		return Balance{}, err
 	}
@@ -317,17 +603,152 @@ func (p Postgres) GetBalance(ctx context.Context, login string) (Balance, error)
 	return *balances[0], nil
 }
 
-func (p Postgres) AddWithdraw(ctx context.Context, login string, order string, wd float64) error {
+// Withdraw debits user balance, stores withdrawal and books it in Ledger in one transaction.
+// Balance row is updated only if it has enough score, otherwise ErrInsufficientFunds returned.
+func (p Postgres) Withdraw(ctx context.Context, login string, order string, wd money.Money) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	_, err := p.Statements.InsertWithdraw.ExecContext(ctx, order, login, wd, time.Now())
-	return err
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	start := time.Now()
+	result, err := tx.StmtContext(ctx, p.Statements.DecreaseBalance).ExecContext(ctx, login, wd)
+	p.observe("DecreaseBalance", start, err)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrInsufficientFunds
+	}
+
+	start = time.Now()
+	_, err = tx.StmtContext(ctx, p.Statements.InsertWithdraw).ExecContext(ctx, order, login, wd, time.Now())
+	p.observe("InsertWithdraw", start, err)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrWithdrawExists
+		}
+		return err
+	}
+
+	start = time.Now()
+	_, err = tx.StmtContext(ctx, p.Statements.InsertLedger).ExecContext(ctx, UserAccount(login), AccountWithdrawals, wd, LedgerWithdraw, order, time.Now())
+	p.observe("InsertLedger", start, err)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReconcileBalances returns users whose Balance row disagrees with sum of their Ledger entries
+func (p Postgres) ReconcileBalances(ctx context.Context) ([]*BalanceMismatch, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	start := time.Now()
+	result, err := getBulk[*BalanceMismatch](ctx, p.Statements.SelectMismatches)
+	p.observe("SelectMismatches", start, err)
+	return result, err
 }
 
 func (p Postgres) GetWithdrawals(ctx context.Context, login string) ([]*Withdraw, error) {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
-	return getBulk[*Withdraw](ctx, p.Statements.SelectWithdrawals, login)
+	start := time.Now()
+	result, err := getBulk[*Withdraw](ctx, p.Statements.SelectWithdrawals, login)
+	p.observe("SelectWithdrawals", start, err)
+	return result, err
+}
+
+// DeleteUser removes user with balance in one transaction. Orders, withdrawals and
+// Ledger entries are kept for accounting, but moved to anonymous login, so order
+// numbers stay taken. User with orders still in processing can't be deleted.
+func (p Postgres) DeleteUser(ctx context.Context, login string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var locked string
+	start := time.Now()
+	err = tx.StmtContext(ctx, p.Statements.SelectUserLock).QueryRowContext(ctx, login).Scan(&locked)
+	p.observe("SelectUserLock", start, err)
+	if err != nil {
+		return err
+	}
+
+	var undone int
+	start = time.Now()
+	err = tx.StmtContext(ctx, p.Statements.CountOrdersUndone).QueryRowContext(ctx, login).Scan(&undone)
+	p.observe("CountOrdersUndone", start, err)
+	if err != nil {
+		return err
+	}
+	if undone > 0 {
+		return ErrOrdersInProgress
+	}
+
+	anonymous, err := anonymousLogin()
+	if err != nil {
+		return err
+	}
+
+	start = time.Now()
+	_, err = tx.StmtContext(ctx, p.Statements.AnonymizeOrders).ExecContext(ctx, login, anonymous)
+	p.observe("AnonymizeOrders", start, err)
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	_, err = tx.StmtContext(ctx, p.Statements.AnonymizeWithdraws).ExecContext(ctx, login, anonymous)
+	p.observe("AnonymizeWithdraws", start, err)
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	_, err = tx.StmtContext(ctx, p.Statements.AnonymizeLedger).ExecContext(ctx, UserAccount(login), UserAccount(anonymous))
+	p.observe("AnonymizeLedger", start, err)
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	_, err = tx.StmtContext(ctx, p.Statements.DeleteBalance).ExecContext(ctx, login)
+	p.observe("DeleteBalance", start, err)
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	_, err = tx.StmtContext(ctx, p.Statements.DeleteUser).ExecContext(ctx, login)
+	p.observe("DeleteUser", start, err)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// observe reports duration of statement started at start to Observer
+func (p Postgres) observe(statement string, start time.Time, err error) {
+	if p.Observer != nil {
+		p.Observer.ObserveStatement(statement, time.Since(start), err)
+	}
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation
 }
 
 func getBulk[T Parser](ctx context.Context, stmt *sql.Stmt, args ...any) ([]T, error) {
@@ -5,51 +5,43 @@ import (
 	"sync"
 	"testing"
 
+	"aprokhorov-diploma-1/internal/money"
+
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgconn"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestPostgres_InitTables(t *testing.T) {
-	tests := []struct {
-		name        string
-		sqlExpected []string
-	}{
-		{
-			name: "Create Tables",
-			sqlExpected: []string{
-				"CREATE TABLE IF NOT EXISTS Users \\( login text PRIMARY KEY, pass_hash text NOT NULL, key text NOT NULL, last_login timestamp NOT NULL \\)",
-				"CREATE TABLE IF NOT EXISTS Balance \\( login text PRIMARY KEY, cur_score double precision NOT NULL, total_wd double precision NOT NULL \\)",
-				"CREATE TABLE IF NOT EXISTS Orders \\( order_id bigint PRIMARY KEY, login text NOT NULL, status text NOT NULL, score double precision NOT NULL, created_at timestamp NOT NULL, last_changed timestamp NOT NULL \\)",
-				"CREATE TABLE IF NOT EXISTS Withdrawals \\( order_id bigint PRIMARY KEY, login text NOT NULL, wd double precision NOT NULL, time timestamp NOT NULL \\)",
-			},
-		},
-	}
-
-	for _, tt := range tests {
-
-		db, mock, err := sqlmock.New()
-		if err != nil {
-			t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
-		}
-		defer db.Close()
-
-		t.Run(tt.name, func(t *testing.T) {
-			p := &Postgres{
-				DB:         db,
-				mutex:      &sync.RWMutex{},
-				Statements: Statements{},
-			}
-
-			for _, query := range tt.sqlExpected {
-				mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(1, 1))
-			}
-			err := p.InitTables(context.Background())
-			assert.NoError(t, err)
-			if err := mock.ExpectationsWereMet(); err != nil {
-				t.Errorf("Unfulfilled expectations: %s", err)
-			}
-		})
-	}
+// Statements expected to be prepared by PrepareStatements, in order
+var preparedStatements = []string{
+	`INSERT INTO Users \(login, pass_hash, key, last_login\) VALUES \(\$1, \$2, \$3, \$4\)`,
+	`SELECT login, pass_hash, key, last_login FROM Users WHERE lower\(login\) = lower\(\$1\)`,
+	`SELECT login, pass_hash, key, last_login FROM Users`,
+	`UPDATE Users SET pass_hash = \$2, key = \$3 WHERE login = \$1`,
+	`INSERT INTO Orders \(order_id, login, status, score, created_at, last_changed\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\)`,
+	`UPDATE Orders SET status = \$2, score = \$3, last_changed = \$4 WHERE order_id = \$1`,
+	`UPDATE Orders SET attempts = attempts \+ 1 WHERE order_id = \$1`,
+	`SELECT login, status FROM Orders WHERE order_id = \$1 FOR UPDATE`,
+	`SELECT order_id, login, status, score, last_changed, created_at, attempts FROM Orders WHERE order_id = \$1`,
+	`SELECT order_id, login, status, score, last_changed, created_at, attempts FROM Orders WHERE login = \$1`,
+	`SELECT order_id, login, status, score, last_changed, created_at, attempts FROM Orders WHERE status != 'INVALID' AND status != 'PROCESSED'`,
+	`INSERT INTO Balance \(login, cur_score, total_wd\) VALUES \(\$1, \$2, \$3\)`,
+	`UPDATE Balance SET cur_score = cur_score \+ \$2 WHERE login = \$1`,
+	`UPDATE Balance SET cur_score = cur_score - \$2, total_wd = total_wd \+ \$2 WHERE login = \$1 AND cur_score >= \$2`,
+	`SELECT login, cur_score, total_wd FROM Balance WHERE login = \$1`,
+	`INSERT INTO Withdrawals \(order_id, login, wd, time\) VALUES \(\$1, \$2, \$3, \$4\)`,
+	`SELECT order_id, login, wd, time FROM Withdrawals WHERE login = \$1`,
+	`INSERT INTO Ledger \(debit, credit, amount, kind, order_id, created_at\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\)`,
+	`WITH entries AS \(.+\) SELECT b.login, b.cur_score, b.total_wd, COALESCE\(s.score, 0\), COALESCE\(s.wd, 0\) FROM Balance b LEFT JOIN sums s`,
+	`SELECT login FROM Users WHERE login = \$1 FOR UPDATE`,
+	`SELECT count\(\*\) FROM Orders WHERE login = \$1 AND status != 'INVALID' AND status != 'PROCESSED'`,
+	`UPDATE Orders SET login = \$2 WHERE login = \$1`,
+	`UPDATE Withdrawals SET login = \$2 WHERE login = \$1`,
+	`UPDATE Ledger SET .+ WHERE debit = \$1 OR credit = \$1`,
+	`DELETE FROM Balance WHERE login = \$1`,
+	`DELETE FROM Users WHERE login = \$1`,
+	`SELECT token_version FROM Users WHERE login = \$1`,
+	`UPDATE Users SET token_version = token_version \+ 1 WHERE login = \$1 RETURNING token_version`,
 }
 
 func TestPostgres_PrepareStatemets(t *testing.T) {
@@ -59,21 +51,7 @@ func TestPostgres_PrepareStatemets(t *testing.T) {
 	}{
 		{
 			name: "Create Statements Test",
-			want: []string{
-				`INSERT INTO Users \(login, pass_hash, key, last_login\) VALUES \(\$1, \$2, \$3, \$4\)`,
-				`SELECT login, pass_hash, key, last_login FROM Users WHERE login = \$1`,
-				`SELECT login, pass_hash, key, last_login FROM Users`,
-				`INSERT INTO Orders \(order_id, login, status, score, created_at, last_changed\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\)`,
-				`UPDATE Orders SET status = \$2, score = \$3, last_changed = \$4 WHERE order_id = \$1`,
-				`SELECT order_id, login, status, score, last_changed, created_at FROM Orders WHERE order_id = \$1`,
-				`SELECT order_id, login, status, score, last_changed, created_at FROM Orders WHERE login = \$1`,
-				`SELECT order_id, login, status, score, last_changed, created_at FROM Orders WHERE status != 'INVALID' AND status != 'PROCESSED'`,
-				`INSERT INTO Balance \(login, cur_score, total_wd\) VALUES \(\$1, \$2, \$3\)`,
-				`UPDATE Balance SET cur_score = \$2, total_wd = \$3 WHERE login = \$1`,
-				`SELECT login, cur_score, total_wd FROM Balance WHERE login = \$1`,
-				`INSERT INTO Withdrawals \(order_id, login, wd, time\) VALUES \(\$1, \$2, \$3, \$4\)`,
-				`SELECT order_id, login, wd, time FROM Withdrawals WHERE login = \$1`,
-			},
+			want: preparedStatements,
 		},
 	}
 	for _, tt := range tests {
@@ -148,23 +126,7 @@ func TestPostgres_RegisterUser(t *testing.T) {
 
 			ctx := context.Background()
 
-			preparation := []string{
-				`INSERT INTO Users \(login, pass_hash, key, last_login\) VALUES \(\$1, \$2, \$3, \$4\)`,
-				`SELECT login, pass_hash, key, last_login FROM Users WHERE login = \$1`,
-				`SELECT login, pass_hash, key, last_login FROM Users`,
-				`INSERT INTO Orders \(order_id, login, status, score, created_at, last_changed\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\)`,
-				`UPDATE Orders SET status = \$2, score = \$3, last_changed = \$4 WHERE order_id = \$1`,
-				`SELECT order_id, login, status, score, last_changed, created_at FROM Orders WHERE order_id = \$1`,
-				`SELECT order_id, login, status, score, last_changed, created_at FROM Orders WHERE login = \$1`,
-				`SELECT order_id, login, status, score, last_changed, created_at FROM Orders WHERE status != 'INVALID' AND status != 'PROCESSED'`,
-				`INSERT INTO Balance \(login, cur_score, total_wd\) VALUES \(\$1, \$2, \$3\)`,
-				`UPDATE Balance SET cur_score = \$2, total_wd = \$3 WHERE login = \$1`,
-				`SELECT login, cur_score, total_wd FROM Balance WHERE login = \$1`,
-				`INSERT INTO Withdrawals \(order_id, login, wd, time\) VALUES \(\$1, \$2, \$3, \$4\)`,
-				`SELECT order_id, login, wd, time FROM Withdrawals WHERE login = \$1`,
-			}
-
-			for _, query := range preparation {
+			for _, query := range preparedStatements {
 				mock.ExpectPrepare(query)
 			}
 
@@ -184,3 +146,282 @@ func TestPostgres_RegisterUser(t *testing.T) {
 		})
 	}
 }
+
+func TestPostgres_ApplyAccrual(t *testing.T) {
+	type args struct {
+		order  string
+		status string
+		score  money.Money
+	}
+	tests := []struct {
+		name          string
+		currentStatus string
+		args          args
+		wantUpdate    bool
+		wantCredit    bool
+	}{
+		{
+			name:          "First transition into PROCESSED credits balance",
+			currentStatus: StatusNew,
+			args:          args{order: "12345678903", status: StatusProcessed, score: 50000},
+			wantUpdate:    true,
+			wantCredit:    true,
+		},
+		{
+			name:          "PROCESSING does not credit balance",
+			currentStatus: StatusNew,
+			args:          args{order: "12345678903", status: StatusProcessing, score: 0},
+			wantUpdate:    true,
+			wantCredit:    false,
+		},
+		{
+			name:          "Already PROCESSED order is not credited twice",
+			currentStatus: StatusProcessed,
+			args:          args{order: "12345678903", status: StatusProcessed, score: 50000},
+			wantUpdate:    false,
+			wantCredit:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			p := &Postgres{
+				DB:         db,
+				mutex:      &sync.RWMutex{},
+				Statements: Statements{},
+			}
+
+			ctx := context.Background()
+
+			for _, query := range preparedStatements {
+				mock.ExpectPrepare(query)
+			}
+			err = p.PrepareStatements(ctx)
+			assert.NoError(t, err)
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT login, status FROM Orders WHERE order_id = \$1 FOR UPDATE`).
+				WithArgs(tt.args.order).
+				WillReturnRows(sqlmock.NewRows([]string{"login", "status"}).AddRow("User1", tt.currentStatus))
+			if tt.wantUpdate {
+				mock.ExpectExec(`UPDATE Orders SET status = \$2, score = \$3, last_changed = \$4 WHERE order_id = \$1`).
+					WithArgs(tt.args.order, tt.args.status, tt.args.score, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			if tt.wantCredit {
+				mock.ExpectExec(`UPDATE Balance SET cur_score = cur_score \+ \$2 WHERE login = \$1`).
+					WithArgs("User1", tt.args.score).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO Ledger \(debit, credit, amount, kind, order_id, created_at\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\)`).
+					WithArgs(AccountAccrual, "user:User1", tt.args.score, LedgerAccrual, tt.args.order, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			if tt.wantUpdate {
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			err = p.ApplyAccrual(ctx, tt.args.order, tt.args.status, tt.args.score)
+			assert.NoError(t, err)
+
+			err = mock.ExpectationsWereMet()
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestPostgres_Withdraw(t *testing.T) {
+	tests := []struct {
+		name        string
+		rowsUpdated int64
+		insertErr   error
+		wantErr     error
+	}{
+		{
+			name:        "Enough score to withdraw",
+			rowsUpdated: 1,
+			wantErr:     nil,
+		},
+		{
+			name:        "Insufficient funds",
+			rowsUpdated: 0,
+			wantErr:     ErrInsufficientFunds,
+		},
+		{
+			name:        "Duplicate order number",
+			rowsUpdated: 1,
+			insertErr:   &pgconn.PgError{Code: pgUniqueViolation},
+			wantErr:     ErrWithdrawExists,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			p := &Postgres{
+				DB:         db,
+				mutex:      &sync.RWMutex{},
+				Statements: Statements{},
+			}
+
+			ctx := context.Background()
+
+			for _, query := range preparedStatements {
+				mock.ExpectPrepare(query)
+			}
+			err = p.PrepareStatements(ctx)
+			assert.NoError(t, err)
+
+			mock.ExpectBegin()
+			mock.ExpectExec(`UPDATE Balance SET cur_score = cur_score - \$2, total_wd = total_wd \+ \$2 WHERE login = \$1 AND cur_score >= \$2`).
+				WithArgs("User1", money.Money(75100)).
+				WillReturnResult(sqlmock.NewResult(0, tt.rowsUpdated))
+			if tt.rowsUpdated > 0 {
+				insert := mock.ExpectExec(`INSERT INTO Withdrawals \(order_id, login, wd, time\) VALUES \(\$1, \$2, \$3, \$4\)`).
+					WithArgs("2377225624", "User1", money.Money(75100), sqlmock.AnyArg())
+				if tt.insertErr != nil {
+					insert.WillReturnError(tt.insertErr)
+				} else {
+					insert.WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectExec(`INSERT INTO Ledger \(debit, credit, amount, kind, order_id, created_at\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\)`).
+						WithArgs("user:User1", AccountWithdrawals, money.Money(75100), LedgerWithdraw, "2377225624", sqlmock.AnyArg()).
+						WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+			}
+			if tt.wantErr == nil {
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			err = p.Withdraw(ctx, "User1", "2377225624", 75100)
+			assert.ErrorIs(t, err, tt.wantErr)
+
+			err = mock.ExpectationsWereMet()
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestPostgres_ReconcileBalances(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	p := &Postgres{
+		DB:         db,
+		mutex:      &sync.RWMutex{},
+		Statements: Statements{},
+	}
+
+	ctx := context.Background()
+
+	for _, query := range preparedStatements {
+		mock.ExpectPrepare(query)
+	}
+	err = p.PrepareStatements(ctx)
+	assert.NoError(t, err)
+
+	mock.ExpectQuery(`WITH entries AS`).
+		WillReturnRows(sqlmock.NewRows([]string{"login", "cur_score", "total_wd", "score", "wd"}).
+			AddRow("User1", "1000.00", "0.00", "500.00", "0"))
+
+	mismatches, err := p.ReconcileBalances(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []*BalanceMismatch{
+		{Login: "User1", CurrentScore: 100000, TotalWithdrawals: 0, LedgerScore: 50000, LedgerTotalWithdrawals: 0},
+	}, mismatches)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+func TestPostgres_DeleteUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		undone  int
+		wantErr error
+	}{
+		{
+			name:   "All orders in final status",
+			undone: 0,
+		},
+		{
+			name:    "Orders in processing",
+			undone:  1,
+			wantErr: ErrOrdersInProgress,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			p := &Postgres{
+				DB:         db,
+				mutex:      &sync.RWMutex{},
+				Statements: Statements{},
+			}
+
+			ctx := context.Background()
+
+			for _, query := range preparedStatements {
+				mock.ExpectPrepare(query)
+			}
+			err = p.PrepareStatements(ctx)
+			assert.NoError(t, err)
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT login FROM Users WHERE login = \$1 FOR UPDATE`).
+				WithArgs("User1").
+				WillReturnRows(sqlmock.NewRows([]string{"login"}).AddRow("User1"))
+			mock.ExpectQuery(`SELECT count\(\*\) FROM Orders`).
+				WithArgs("User1").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.undone))
+			if tt.wantErr == nil {
+				mock.ExpectExec(`UPDATE Orders SET login = \$2 WHERE login = \$1`).
+					WithArgs("User1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec(`UPDATE Withdrawals SET login = \$2 WHERE login = \$1`).
+					WithArgs("User1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE Ledger SET`).
+					WithArgs("user:User1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 3))
+				mock.ExpectExec(`DELETE FROM Balance WHERE login = \$1`).
+					WithArgs("User1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`DELETE FROM Users WHERE login = \$1`).
+					WithArgs("User1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			err = p.DeleteUser(ctx, "User1")
+			assert.ErrorIs(t, err, tt.wantErr)
+
+			err = mock.ExpectationsWereMet()
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -2,12 +2,74 @@ package storage
 
 import (
 	"context"
+	"crypto/rand"
+	"database/sql"
 	"database/sql/driver"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
+
+	"aprokhorov-diploma-1/internal/cache"
+	"aprokhorov-diploma-1/internal/money"
+)
+
+// ErrUserExists is returned when login is taken already
+var ErrUserExists = errors.New("user already exists")
+
+// ErrOrderExists is returned when order has been uploaded already
+var ErrOrderExists = errors.New("order already exists")
+
+// ErrBalanceExists is returned when user balance has been created already
+var ErrBalanceExists = errors.New("balance already exists")
+
+// ErrInsufficientFunds is returned when user balance is less than requested withdraw
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// ErrWithdrawExists is returned when withdraw for the order has been made already
+var ErrWithdrawExists = errors.New("withdraw for order already exists")
+
+// ErrOrdersInProgress is returned when user still has orders not in final status
+var ErrOrdersInProgress = errors.New("orders are still in processing")
+
+// Order statuses
+const (
+	StatusNew        = "NEW"
+	StatusProcessing = "PROCESSING"
+	StatusInvalid    = "INVALID"
+	StatusProcessed  = "PROCESSED"
 )
 
+// Ledger entry kinds
+const (
+	LedgerAccrual    = "ACCRUAL"
+	LedgerWithdraw   = "WITHDRAW"
+	LedgerAdjustment = "ADJUSTMENT"
+)
+
+// Ledger system accounts, every entry moves amount from debit account to credit one
+const (
+	AccountAccrual     = "system:accrual"
+	AccountWithdrawals = "system:withdrawals"
+	AccountAdjustments = "system:adjustments"
+)
+
+// UserAccount returns Ledger account of user
+func UserAccount(login string) string {
+	return "user:" + login
+}
+
+// anonymousLogin returns random login records of deleted user are moved to
+func anonymousLogin() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "deleted-" + hex.EncodeToString(b), nil
+}
+
 type JSONTime time.Time
 
 func (t JSONTime) MarshalJSON() ([]byte, error) {
@@ -70,12 +132,13 @@ func (u *User) Parse(values []string) error {
 }
 
 type Order struct {
-	OrderID    string   `db:"order_id" json:"number"`
-	Login      string   `db:"login" json:"-"`
-	Status     string   `db:"status" json:"status"`
-	Score      float64  `db:"score" json:"accrual"`
-	LastChange JSONTime `db:"last_changed" json:"-"`
-	UploadedAt JSONTime `db:"created_at" json:"uploaded_at"`
+	OrderID    string      `db:"order_id" json:"number"`
+	Login      string      `db:"login" json:"-"`
+	Status     string      `db:"status" json:"status"`
+	Score      money.Money `db:"score" json:"accrual"`
+	LastChange JSONTime    `db:"last_changed" json:"-"`
+	UploadedAt JSONTime    `db:"created_at" json:"uploaded_at"`
+	Attempts   int         `db:"attempts" json:"-"`
 }
 
 func (o *Order) New() Parser { return &Order{} }
@@ -97,7 +160,7 @@ func (o *Order) Parse(values []string) error {
 			return err
 		}
 		// Value Order:
-		// order_id, login, status, score, last_changed
+		// order_id, login, status, score, last_changed, created_at, attempts
 		switch i {
 		case 0:
 			o.OrderID = v
@@ -106,7 +169,7 @@ func (o *Order) Parse(values []string) error {
 		case 2:
 			o.Status = v
 		case 3:
-			score, err := strconv.ParseFloat(v, 64)
+			score, err := money.Parse(v)
 			if err != nil {
 				return err
 			}
@@ -124,16 +187,22 @@ func (o *Order) Parse(values []string) error {
 				return err
 			}
 			o.UploadedAt = JSONTime(time)
+		case 6:
+			attempts, err := strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+			o.Attempts = attempts
 		}
 	}
 	return nil
 }
 
 type Withdraw struct {
-	OrderID  string   `db:"order_id" json:"order"`
-	Login    string   `db:"login" json:"-"`
-	Withdraw float64  `db:"wd" json:"sum"`
-	Time     JSONTime `db:"time" json:"processed_at"`
+	OrderID  string      `db:"order_id" json:"order"`
+	Login    string      `db:"login" json:"-"`
+	Withdraw money.Money `db:"wd" json:"sum"`
+	Time     JSONTime    `db:"time" json:"processed_at"`
 }
 
 func (w *Withdraw) New() Parser { return &Withdraw{} }
@@ -162,7 +231,7 @@ func (w *Withdraw) Parse(values []string) error {
 		case 1:
 			w.Login = v
 		case 2:
-			vv, err := strconv.ParseFloat(v, 64)
+			vv, err := money.Parse(v)
 			if err != nil {
 				return err
 			}
@@ -181,10 +250,12 @@ func (w *Withdraw) Parse(values []string) error {
 	return nil
 }
 
+// Balance is materialized view of Ledger: every operation updates Balance row and books Ledger entries
+// in one transaction, so Ledger stays the source of truth and ReconcileBalances finds rows drifted from it
 type Balance struct {
-	Login            string  `db:"login" json:"-"`
-	CurrentScore     float64 `db:"cur_score" json:"current"`
-	TotalWithdrawals float64 `db:"total_wd" json:"withdrawn"`
+	Login            string      `db:"login" json:"-"`
+	CurrentScore     money.Money `db:"cur_score" json:"current"`
+	TotalWithdrawals money.Money `db:"total_wd" json:"withdrawn"`
 }
 
 func (b *Balance) New() Parser { return &Balance{} }
@@ -212,13 +283,13 @@ func (b *Balance) Parse(values []string) error {
 		case 0:
 			b.Login = v
 		case 1:
-			vv, err := strconv.ParseFloat(v, 64)
+			vv, err := money.Parse(v)
 			if err != nil {
 				return err
 			}
 			b.CurrentScore = vv
 		case 2:
-			vv, err := strconv.ParseFloat(v, 64)
+			vv, err := money.Parse(v)
 			if err != nil {
 				return err
 			}
@@ -228,21 +299,130 @@ func (b *Balance) Parse(values []string) error {
 	return nil
 }
 
+// BalanceMismatch is a user whose cached Balance disagrees with Ledger
+type BalanceMismatch struct {
+	Login                  string      `db:"login"`
+	CurrentScore           money.Money `db:"cur_score"`
+	TotalWithdrawals       money.Money `db:"total_wd"`
+	LedgerScore            money.Money
+	LedgerTotalWithdrawals money.Money
+}
+
+func (m *BalanceMismatch) New() Parser { return &BalanceMismatch{} }
+
+func (m *BalanceMismatch) Parse(values []string) error {
+	*m = BalanceMismatch{}
+	if values == nil {
+		return nil
+	}
+
+	for i, v := range values {
+		// Value Order:
+		// login, cur_score, total_wd, ledger score, ledger withdrawals
+		if i == 0 {
+			m.Login = v
+			continue
+		}
+
+		vv, err := money.Parse(v)
+		if err != nil {
+			return err
+		}
+		switch i {
+		case 1:
+			m.CurrentScore = vv
+		case 2:
+			m.TotalWithdrawals = vv
+		case 3:
+			m.LedgerScore = vv
+		case 4:
+			m.LedgerTotalWithdrawals = vv
+		}
+	}
+	return nil
+}
+
+func (m BalanceMismatch) String() string {
+	return fmt.Sprintf("Login:%s, Balance:%v/%v, Ledger:%v/%v", m.Login, m.CurrentScore, m.TotalWithdrawals, m.LedgerScore, m.LedgerTotalWithdrawals)
+}
+
 // END
 
 // Interface for use in Project
 type Storage interface {
 	RegisterUser(ctx context.Context, login string, hash string, key string) error
+	// GetUser finds user by login case-insensitively, User.Login is as it has been registered
 	GetUser(ctx context.Context, login string) (User, error)
 	GetUsers(ctx context.Context) ([]*User, error)
+	UpdatePassword(ctx context.Context, login string, hash string, key string) error
+	DeleteUser(ctx context.Context, login string) error
+	// GetTokenVersion returns version of signed auth tokens of user, sql.ErrNoRows if there is no user
+	GetTokenVersion(ctx context.Context, login string) (int64, error)
+	// BumpTokenVersion increments token version, so all tokens issued before are revoked
+	BumpTokenVersion(ctx context.Context, login string) (int64, error)
 	AddOrder(ctx context.Context, login string, order string) error
-	ModifyOrder(ctx context.Context, order string, status string, score float64) error
+	ModifyOrder(ctx context.Context, order string, status string, score money.Money) error
+	AddOrderAttempt(ctx context.Context, order string) error
+	ApplyAccrual(ctx context.Context, order string, status string, score money.Money) error
 	GetOrder(ctx context.Context, order string) (Order, error)
 	GetOrdersByUser(ctx context.Context, login string) ([]*Order, error)
 	GetOrdersUndone(ctx context.Context) ([]*Order, error)
-	AddBalance(ctx context.Context, login string, score float64, wd float64) error
-	ModifyBalance(ctx context.Context, login string, score float64, wd float64) error
+	AddBalance(ctx context.Context, login string, score money.Money, wd money.Money) error
+	AdjustBalance(ctx context.Context, login string, amount money.Money) error
 	GetBalance(ctx context.Context, login string) (Balance, error)
-	AddWithdraw(ctx context.Context, login string, order string, wd float64) error
+	Withdraw(ctx context.Context, login string, order string, wd money.Money) error
 	GetWithdrawals(ctx context.Context, login string) ([]*Withdraw, error)
+	// ReconcileBalances returns Balance rows disagreeing with sums of Ledger entries
+	ReconcileBalances(ctx context.Context) ([]*BalanceMismatch, error)
+	// Ping checks connection to storage
+	Ping(ctx context.Context) error
+	GracefulShutdown()
+}
+
+// StatementObserver gets duration and result of prepared statement execution,
+// statement is named after Statements field
+type StatementObserver interface {
+	ObserveStatement(statement string, duration time.Duration, err error)
+}
+
+// DSN prefix selecting in-memory Storage
+const MemoryDSN = "memory://"
+
+// New opens Storage by DSN: in-memory one for "memory://", Postgres otherwise
+func New(ctx context.Context, dsn string, dbname string) (Storage, error) {
+	if strings.HasPrefix(dsn, MemoryDSN) {
+		return NewMemory(), nil
+	}
+
+	database, err := NewPostgresClient(ctx, dsn, dbname)
+	if err != nil {
+		return nil, err
+	}
+	return &database, nil
+}
+
+// tokenVersions is Storage seen by signed AuthCache
+type tokenVersions struct {
+	storage Storage
+}
+
+// NewTokenVersions adapts Storage to cache.TokenVersions, missed user is cache.ErrUnknownUser
+func NewTokenVersions(s Storage) cache.TokenVersions {
+	return tokenVersions{storage: s}
+}
+
+func (tv tokenVersions) GetTokenVersion(ctx context.Context, login string) (int64, error) {
+	version, err := tv.storage.GetTokenVersion(ctx, login)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, cache.ErrUnknownUser
+	}
+	return version, err
+}
+
+func (tv tokenVersions) BumpTokenVersion(ctx context.Context, login string) (int64, error) {
+	version, err := tv.storage.BumpTokenVersion(ctx, login)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, cache.ErrUnknownUser
+	}
+	return version, err
 }
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"aprokhorov-diploma-1/internal/cache"
+	"aprokhorov-diploma-1/internal/money"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Env variable with Postgres URI to run conformance suite against, suite is skipped for Postgres if empty
+const testDatabaseEnv = "GOPHERMART_TEST_DATABASE_URI"
+
+func TestMemory_Conformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		return NewMemory()
+	})
+}
+
+func TestPostgres_Conformance(t *testing.T) {
+	uri := os.Getenv(testDatabaseEnv)
+	if uri == "" {
+		t.Skipf("%s is not set", testDatabaseEnv)
+	}
+
+	testStorageConformance(t, func(t *testing.T) Storage {
+		ctx := context.Background()
+		database, err := NewPostgresClient(ctx, uri, "")
+		require.NoError(t, err)
+		_, err = database.DB.ExecContext(ctx, "TRUNCATE Users, Orders, Balance, Withdrawals, Ledger")
+		require.NoError(t, err)
+		t.Cleanup(database.GracefulShutdown)
+		return &database
+	})
+}
+
+func TestTokenVersions(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory()
+	require.NoError(t, s.RegisterUser(ctx, "User1", "hash", ""))
+	versions := NewTokenVersions(s)
+
+	version, err := versions.BumpTokenVersion(ctx, "User1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), version)
+
+	_, err = versions.GetTokenVersion(ctx, "Nobody")
+	assert.ErrorIs(t, err, cache.ErrUnknownUser)
+	_, err = versions.BumpTokenVersion(ctx, "Nobody")
+	assert.ErrorIs(t, err, cache.ErrUnknownUser)
+}
+
+// testStorageConformance checks semantics every Storage implementation must share
+func testStorageConformance(t *testing.T, newStorage func(t *testing.T) Storage) {
+	ctx := context.Background()
+
+	t.Run("Users", func(t *testing.T) {
+		s := newStorage(t)
+		require.NoError(t, s.Ping(ctx))
+
+		require.NoError(t, s.RegisterUser(ctx, "User1", "hash", "key"))
+		assert.ErrorIs(t, s.RegisterUser(ctx, "User1", "hash2", "key2"), ErrUserExists)
+		assert.ErrorIs(t, s.RegisterUser(ctx, "user1", "hash2", "key2"), ErrUserExists)
+
+		user, err := s.GetUser(ctx, "User1")
+		require.NoError(t, err)
+		assert.Equal(t, "User1", user.Login)
+		assert.Equal(t, "hash", user.PassHash)
+		assert.Equal(t, "key", user.Key)
+
+		// Login is found in any case, but returned as registered
+		user, err = s.GetUser(ctx, "uSER1")
+		require.NoError(t, err)
+		assert.Equal(t, "User1", user.Login)
+
+		_, err = s.GetUser(ctx, "Nobody")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		require.NoError(t, s.UpdatePassword(ctx, "User1", "$argon2id$new", ""))
+		user, err = s.GetUser(ctx, "User1")
+		require.NoError(t, err)
+		assert.Equal(t, "$argon2id$new", user.PassHash)
+		assert.Equal(t, "", user.Key)
+		assert.ErrorIs(t, s.UpdatePassword(ctx, "Nobody", "hash", ""), sql.ErrNoRows)
+
+		require.NoError(t, s.AddBalance(ctx, "User1", 0, 0))
+		assert.ErrorIs(t, s.AddBalance(ctx, "User1", 0, 0), ErrBalanceExists)
+
+		_, err = s.GetBalance(ctx, "Nobody")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("TokenVersion", func(t *testing.T) {
+		s := newStorage(t)
+
+		require.NoError(t, s.RegisterUser(ctx, "User1", "hash", ""))
+		version, err := s.GetTokenVersion(ctx, "User1")
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), version)
+
+		version, err = s.BumpTokenVersion(ctx, "User1")
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), version)
+		version, err = s.GetTokenVersion(ctx, "User1")
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), version)
+
+		_, err = s.GetTokenVersion(ctx, "Nobody")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		_, err = s.BumpTokenVersion(ctx, "Nobody")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		require.NoError(t, s.DeleteUser(ctx, "User1"))
+		_, err = s.GetTokenVersion(ctx, "User1")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("Orders", func(t *testing.T) {
+		s := newStorage(t)
+
+		require.NoError(t, s.AddOrder(ctx, "User1", "12345678903"))
+		require.NoError(t, s.AddOrder(ctx, "User2", "2377225624"))
+		assert.ErrorIs(t, s.AddOrder(ctx, "User2", "12345678903"), ErrOrderExists)
+
+		order, err := s.GetOrder(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, "User1", order.Login)
+		assert.Equal(t, StatusNew, order.Status)
+		assert.Equal(t, 0, order.Attempts)
+
+		_, err = s.GetOrder(ctx, "79927398713")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		orders, err := s.GetOrdersByUser(ctx, "User1")
+		require.NoError(t, err)
+		require.Len(t, orders, 1)
+		assert.Equal(t, "12345678903", orders[0].OrderID)
+
+		require.NoError(t, s.AddOrderAttempt(ctx, "12345678903"))
+		order, err = s.GetOrder(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, 1, order.Attempts)
+
+		require.NoError(t, s.ModifyOrder(ctx, "2377225624", StatusInvalid, 0))
+		undone, err := s.GetOrdersUndone(ctx)
+		require.NoError(t, err)
+		require.Len(t, undone, 1)
+		assert.Equal(t, "12345678903", undone[0].OrderID)
+	})
+
+	t.Run("ApplyAccrual", func(t *testing.T) {
+		s := newStorage(t)
+
+		require.NoError(t, s.AddBalance(ctx, "User1", 0, 0))
+		require.NoError(t, s.AddOrder(ctx, "User1", "12345678903"))
+
+		require.NoError(t, s.ApplyAccrual(ctx, "12345678903", StatusProcessing, 0))
+		balance, err := s.GetBalance(ctx, "User1")
+		require.NoError(t, err)
+		assert.Equal(t, money.Money(0), balance.CurrentScore)
+
+		// Credit only once, even if PROCESSED is fetched twice
+		require.NoError(t, s.ApplyAccrual(ctx, "12345678903", StatusProcessed, 72998))
+		require.NoError(t, s.ApplyAccrual(ctx, "12345678903", StatusProcessed, 72998))
+		balance, err = s.GetBalance(ctx, "User1")
+		require.NoError(t, err)
+		assert.Equal(t, money.Money(72998), balance.CurrentScore)
+
+		// Final status is never changed
+		require.NoError(t, s.ApplyAccrual(ctx, "12345678903", StatusInvalid, 0))
+		order, err := s.GetOrder(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, StatusProcessed, order.Status)
+		assert.Equal(t, money.Money(72998), order.Score)
+
+		assert.ErrorIs(t, s.ApplyAccrual(ctx, "79927398713", StatusProcessed, 100), sql.ErrNoRows)
+	})
+
+	t.Run("Withdraw", func(t *testing.T) {
+		s := newStorage(t)
+
+		require.NoError(t, s.AddBalance(ctx, "User1", 0, 0))
+		require.NoError(t, s.AdjustBalance(ctx, "User1", 100000))
+
+		assert.ErrorIs(t, s.Withdraw(ctx, "User1", "2377225624", 100001), ErrInsufficientFunds)
+		require.NoError(t, s.Withdraw(ctx, "User1", "2377225624", 75100))
+		assert.ErrorIs(t, s.Withdraw(ctx, "User1", "2377225624", 100), ErrWithdrawExists)
+
+		balance, err := s.GetBalance(ctx, "User1")
+		require.NoError(t, err)
+		assert.Equal(t, money.Money(24900), balance.CurrentScore)
+		assert.Equal(t, money.Money(75100), balance.TotalWithdrawals)
+
+		withdrawals, err := s.GetWithdrawals(ctx, "User1")
+		require.NoError(t, err)
+		require.Len(t, withdrawals, 1)
+		assert.Equal(t, "2377225624", withdrawals[0].OrderID)
+		assert.Equal(t, money.Money(75100), withdrawals[0].Withdraw)
+	})
+
+	t.Run("ReconcileBalances", func(t *testing.T) {
+		s := newStorage(t)
+
+		require.NoError(t, s.AddBalance(ctx, "User1", 0, 0))
+		require.NoError(t, s.AddOrder(ctx, "User1", "12345678903"))
+		require.NoError(t, s.ApplyAccrual(ctx, "12345678903", StatusProcessed, 50000))
+		require.NoError(t, s.Withdraw(ctx, "User1", "2377225624", 20000))
+		require.NoError(t, s.AdjustBalance(ctx, "User1", -1000))
+
+		mismatches, err := s.ReconcileBalances(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, mismatches)
+
+		// Balance created with score bypasses Ledger
+		require.NoError(t, s.AddBalance(ctx, "User2", 500, 0))
+		mismatches, err = s.ReconcileBalances(ctx)
+		require.NoError(t, err)
+		require.Len(t, mismatches, 1)
+		assert.Equal(t, "User2", mismatches[0].Login)
+		assert.Equal(t, money.Money(0), mismatches[0].LedgerScore)
+	})
+
+	t.Run("DeleteUser", func(t *testing.T) {
+		s := newStorage(t)
+
+		require.NoError(t, s.RegisterUser(ctx, "User1", "hash", ""))
+		require.NoError(t, s.AddBalance(ctx, "User1", 0, 0))
+		require.NoError(t, s.AddOrder(ctx, "User1", "12345678903"))
+
+		// Not while accrual is pending
+		assert.ErrorIs(t, s.DeleteUser(ctx, "User1"), ErrOrdersInProgress)
+
+		require.NoError(t, s.ApplyAccrual(ctx, "12345678903", StatusProcessed, 50000))
+		require.NoError(t, s.Withdraw(ctx, "User1", "2377225624", 20000))
+		require.NoError(t, s.DeleteUser(ctx, "User1"))
+
+		_, err := s.GetUser(ctx, "User1")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		_, err = s.GetBalance(ctx, "User1")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		orders, err := s.GetOrdersByUser(ctx, "User1")
+		require.NoError(t, err)
+		assert.Empty(t, orders)
+		withdrawals, err := s.GetWithdrawals(ctx, "User1")
+		require.NoError(t, err)
+		assert.Empty(t, withdrawals)
+
+		// Order numbers stay taken by anonymous owner
+		order, err := s.GetOrder(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.NotEqual(t, "User1", order.Login)
+
+		// Login can be registered again with clean Ledger
+		require.NoError(t, s.RegisterUser(ctx, "User1", "hash", ""))
+		require.NoError(t, s.AddBalance(ctx, "User1", 0, 0))
+		mismatches, err := s.ReconcileBalances(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, mismatches)
+
+		assert.ErrorIs(t, s.DeleteUser(ctx, "Nobody"), sql.ErrNoRows)
+	})
+}
@@ -0,0 +1,83 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemStore keeps failure counters in process memory
+type MemStore struct {
+	mutex    *sync.Mutex
+	counters map[string]Counter
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		mutex:    &sync.Mutex{},
+		counters: make(map[string]Counter),
+	}
+}
+
+func (ms *MemStore) Get(ctx context.Context, key string) (Counter, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.counters[key], nil
+}
+
+func (ms *MemStore) Fail(ctx context.Context, key string, now time.Time, since time.Time) (int, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	counter := ms.counters[key]
+	if counter.LastFailure.Before(since) {
+		counter.Failures = 0
+		counter.Lockouts = 0
+	}
+	counter.Failures++
+	counter.LastFailure = now
+	ms.counters[key] = counter
+	return counter.Failures, nil
+}
+
+func (ms *MemStore) Lock(ctx context.Context, key string, now time.Time, until time.Time) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	counter := ms.counters[key]
+	if counter.LockedUntil.After(now) {
+		return false, nil
+	}
+	counter.LockedUntil = until
+	counter.Lockouts++
+	ms.counters[key] = counter
+	return true, nil
+}
+
+func (ms *MemStore) Forgive(ctx context.Context, key string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	counter, exist := ms.counters[key]
+	if !exist || counter.Failures == 0 {
+		return nil
+	}
+	counter.Failures--
+	ms.counters[key] = counter
+	return nil
+}
+
+func (ms *MemStore) Reset(ctx context.Context, key string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	delete(ms.counters, key)
+	return nil
+}
+
+func (ms *MemStore) Cleanup(ctx context.Context, before time.Time) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for key, counter := range ms.counters {
+		if counter.LastFailure.Before(before) && counter.LockedUntil.Before(before) {
+			delete(ms.counters, key)
+		}
+	}
+	return nil
+}
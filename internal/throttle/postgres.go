@@ -0,0 +1,126 @@
+package throttle
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PGStore keeps failure counters in Postgres LoginFailures table,
+// so lockouts are shared between gophermart replicas
+type PGStore struct {
+	DB         *sql.DB
+	Statements PGStoreStatements
+}
+
+type PGStoreStatements struct {
+	SelectCounter    *sql.Stmt
+	UpsertFailure    *sql.Stmt
+	UpdateLock       *sql.Stmt
+	DeleteCounter    *sql.Stmt
+	DeleteStale      *sql.Stmt
+	DecreaseFailures *sql.Stmt
+}
+
+func NewPGStore(ctx context.Context, db *sql.DB) (*PGStore, error) {
+	ps := &PGStore{DB: db}
+
+	stmt, err := db.PrepareContext(ctx, "SELECT failures, last_failure, locked_until, lockouts FROM LoginFailures WHERE key = $1")
+	if err != nil {
+		return nil, err
+	}
+	ps.Statements.SelectCounter = stmt
+
+	stmt, err = db.PrepareContext(ctx, `INSERT INTO LoginFailures (key, failures, last_failure) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN LoginFailures.last_failure < $3 THEN 1 ELSE LoginFailures.failures + 1 END,
+			lockouts = CASE WHEN LoginFailures.last_failure < $3 THEN 0 ELSE LoginFailures.lockouts END,
+			last_failure = EXCLUDED.last_failure
+		RETURNING failures`)
+	if err != nil {
+		return nil, err
+	}
+	ps.Statements.UpsertFailure = stmt
+
+	stmt, err = db.PrepareContext(ctx, `UPDATE LoginFailures SET locked_until = $2, lockouts = lockouts + 1
+		WHERE key = $1 AND (locked_until IS NULL OR locked_until <= $3)`)
+	if err != nil {
+		return nil, err
+	}
+	ps.Statements.UpdateLock = stmt
+
+	stmt, err = db.PrepareContext(ctx, "DELETE FROM LoginFailures WHERE key = $1")
+	if err != nil {
+		return nil, err
+	}
+	ps.Statements.DeleteCounter = stmt
+
+	stmt, err = db.PrepareContext(ctx, "DELETE FROM LoginFailures WHERE last_failure < $1 AND (locked_until IS NULL OR locked_until < $1)")
+	if err != nil {
+		return nil, err
+	}
+	ps.Statements.DeleteStale = stmt
+
+	stmt, err = db.PrepareContext(ctx, "UPDATE LoginFailures SET failures = failures - 1 WHERE key = $1 AND failures > 0")
+	if err != nil {
+		return nil, err
+	}
+	ps.Statements.DecreaseFailures = stmt
+
+	return ps, nil
+}
+
+func (ps *PGStore) Get(ctx context.Context, key string) (Counter, error) {
+	var counter Counter
+	var lockedUntil sql.NullTime
+	err := ps.Statements.SelectCounter.QueryRowContext(ctx, key).Scan(&counter.Failures, &counter.LastFailure, &lockedUntil, &counter.Lockouts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Counter{}, nil
+	}
+	if err != nil {
+		return Counter{}, err
+	}
+	counter.LockedUntil = lockedUntil.Time
+	return counter, nil
+}
+
+func (ps *PGStore) Fail(ctx context.Context, key string, now time.Time, since time.Time) (int, error) {
+	var failures int
+	err := ps.Statements.UpsertFailure.QueryRowContext(ctx, key, now, since).Scan(&failures)
+	return failures, err
+}
+
+func (ps *PGStore) Lock(ctx context.Context, key string, now time.Time, until time.Time) (bool, error) {
+	result, err := ps.Statements.UpdateLock.ExecContext(ctx, key, until, now)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (ps *PGStore) Forgive(ctx context.Context, key string) error {
+	_, err := ps.Statements.DecreaseFailures.ExecContext(ctx, key)
+	return err
+}
+
+func (ps *PGStore) Reset(ctx context.Context, key string) error {
+	_, err := ps.Statements.DeleteCounter.ExecContext(ctx, key)
+	return err
+}
+
+func (ps *PGStore) Cleanup(ctx context.Context, before time.Time) error {
+	_, err := ps.Statements.DeleteStale.ExecContext(ctx, before)
+	return err
+}
+
+// Close releases prepared statements, database itself is closed by its owner
+func (ps *PGStore) Close() {
+	ps.Statements.SelectCounter.Close()
+	ps.Statements.UpsertFailure.Close()
+	ps.Statements.UpdateLock.Close()
+	ps.Statements.DeleteCounter.Close()
+	ps.Statements.DeleteStale.Close()
+	ps.Statements.DecreaseFailures.Close()
+}
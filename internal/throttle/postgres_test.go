@@ -0,0 +1,69 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPGStore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectPrepare(`SELECT failures, last_failure, locked_until, lockouts FROM LoginFailures WHERE key = \$1`)
+	mock.ExpectPrepare(`INSERT INTO LoginFailures \(key, failures, last_failure\) VALUES \(\$1, 1, \$2\)`)
+	mock.ExpectPrepare(`UPDATE LoginFailures SET locked_until = \$2, lockouts = lockouts \+ 1`)
+	mock.ExpectPrepare(`DELETE FROM LoginFailures WHERE key = \$1`)
+	mock.ExpectPrepare(`DELETE FROM LoginFailures WHERE last_failure < \$1`)
+	mock.ExpectPrepare(`UPDATE LoginFailures SET failures = failures - 1 WHERE key = \$1 AND failures > 0`)
+
+	ctx := context.Background()
+	ps, err := NewPGStore(ctx, db)
+	assert.NoError(t, err)
+
+	now := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT failures, last_failure, locked_until, lockouts FROM LoginFailures`).
+		WithArgs("login:User1").
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "last_failure", "locked_until", "lockouts"}))
+	mock.ExpectQuery(`INSERT INTO LoginFailures`).
+		WithArgs("login:User1", now, now.Add(-time.Hour)).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(5))
+	mock.ExpectExec(`UPDATE LoginFailures SET locked_until`).
+		WithArgs("login:User1", now.Add(time.Minute), now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE LoginFailures SET locked_until`).
+		WithArgs("login:User1", now.Add(2*time.Minute), now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT failures, last_failure, locked_until, lockouts FROM LoginFailures`).
+		WithArgs("login:User1").
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "last_failure", "locked_until", "lockouts"}).AddRow(5, now, now.Add(time.Minute), 1))
+
+	counter, err := ps.Get(ctx, "login:User1")
+	assert.NoError(t, err)
+	assert.Equal(t, Counter{}, counter)
+
+	failures, err := ps.Fail(ctx, "login:User1", now, now.Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, failures)
+
+	locked, err := ps.Lock(ctx, "login:User1", now, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, locked)
+
+	// Locked already
+	locked, err = ps.Lock(ctx, "login:User1", now, now.Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.False(t, locked)
+
+	counter, err = ps.Get(ctx, "login:User1")
+	assert.NoError(t, err)
+	assert.Equal(t, Counter{Failures: 5, LastFailure: now, LockedUntil: now.Add(time.Minute), Lockouts: 1}, counter)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,197 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"aprokhorov-diploma-1/internal/logger"
+)
+
+const parent string = "Throttle"
+
+// Counter is failed attempts state of one key
+type Counter struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+	Lockouts    int // lockouts since failures were forgotten
+}
+
+// Store keeps failure counters, it is shared between gophermart replicas when kept in Postgres
+type Store interface {
+	// Get returns counter of key, zero Counter if there were no failures
+	Get(ctx context.Context, key string) (Counter, error)
+	// Fail registers failure at now and returns failures count, failures and lockouts made before since are forgotten
+	Fail(ctx context.Context, key string, now time.Time, since time.Time) (int, error)
+	// Lock locks key out till until and counts lockout, returns false if key is still locked at now
+	Lock(ctx context.Context, key string, now time.Time, until time.Time) (bool, error)
+	// Forgive takes one failure back, counter is never negative
+	Forgive(ctx context.Context, key string) error
+	Reset(ctx context.Context, key string) error
+	// Cleanup drops counters with last failure before given time
+	Cleanup(ctx context.Context, before time.Time) error
+}
+
+// Policy sets how many failures are allowed and how long lockout lasts
+type Policy struct {
+	LoginFailures int           // failures per login before lockout
+	IPFailures    int           // failures per IP before lockout
+	Lockout       time.Duration // first lockout, doubled on every next one
+	MaxLockout    time.Duration
+	Window        time.Duration // failures older than Window are forgotten
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		LoginFailures: 5,
+		IPFailures:    20,
+		Lockout:       30 * time.Second,
+		MaxLockout:    time.Hour,
+		Window:        24 * time.Hour,
+	}
+}
+
+// Throttler counts failed logins per login and per IP and locks them out
+// for exponentially growing time after too many failures
+type Throttler struct {
+	store  Store
+	policy Policy
+	log    logger.Logger
+	now    func() time.Time
+}
+
+func New(store Store, policy Policy, log logger.Logger) *Throttler {
+	return &Throttler{
+		store:  store,
+		policy: policy,
+		log:    log,
+		now:    time.Now,
+	}
+}
+
+// Logins are case-insensitive, so are their counters
+func loginKey(login string) string {
+	return "login:" + strings.ToLower(login)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns time left till end of lockout of login or IP, zero if attempt is allowed
+func (t *Throttler) Check(ctx context.Context, login string, ip string) (time.Duration, error) {
+	var retryAfter time.Duration
+	for _, key := range []string{loginKey(login), ipKey(ip)} {
+		counter, err := t.store.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if left := counter.LockedUntil.Sub(t.now()); left > retryAfter {
+			retryAfter = left
+		}
+	}
+	return retryAfter, nil
+}
+
+// Attempt counts login attempt as failure before password is checked, so concurrent attempts
+// can't get around the limit. Returns time left till end of lockout if login or IP is locked out
+// or has no attempts left, zero if password may be checked.
+func (t *Throttler) Attempt(ctx context.Context, login string, ip string) (time.Duration, error) {
+	keys := []struct {
+		name    string
+		allowed int
+	}{
+		{loginKey(login), t.policy.LoginFailures},
+		{ipKey(ip), t.policy.IPFailures},
+	}
+
+	now := t.now()
+	counters := make([]Counter, len(keys))
+	var retryAfter time.Duration
+	for i, key := range keys {
+		counter, err := t.store.Get(ctx, key.name)
+		if err != nil {
+			return 0, err
+		}
+		if left := counter.LockedUntil.Sub(now); left > retryAfter {
+			retryAfter = left
+		}
+		counters[i] = counter
+	}
+	if retryAfter > 0 {
+		return retryAfter, nil
+	}
+
+	for i, key := range keys {
+		lockout, err := t.count(ctx, key.name, key.allowed, counters[i], now)
+		if err != nil {
+			return 0, err
+		}
+		if lockout > retryAfter {
+			retryAfter = lockout
+		}
+	}
+	return retryAfter, nil
+}
+
+// Success forgets failures of login, IP counter keeps previous failures so attacker
+// can't reset it with own account, only successful attempt itself is taken back
+func (t *Throttler) Success(ctx context.Context, login string, ip string) error {
+	if err := t.store.Reset(ctx, loginKey(login)); err != nil {
+		return err
+	}
+	return t.store.Forgive(ctx, ipKey(ip))
+}
+
+// HouseKeeper drops counters without failures during policy window
+func (t *Throttler) HouseKeeper(ctx context.Context) error {
+	return t.store.Cleanup(ctx, t.now().Add(-t.policy.Window))
+}
+
+// count registers attempt of key, counter is state of key before attempt.
+// Attempt over allowed ones locks key out. The first attempt after lockout has ended
+// locks key for twice longer too, but it is let to password check: it stays locked
+// if password is wrong and is reset by Success otherwise.
+func (t *Throttler) count(ctx context.Context, key string, allowed int, counter Counter, now time.Time) (time.Duration, error) {
+	failures, err := t.store.Fail(ctx, key, now, now.Add(-t.policy.Window))
+	if err != nil {
+		return 0, err
+	}
+	if failures <= allowed {
+		return 0, nil
+	}
+
+	if now.Sub(counter.LastFailure) > t.policy.Window {
+		// Lockouts are forgotten together with failures
+		counter.Lockouts = 0
+	}
+	lockout := t.lockout(counter.Lockouts)
+	locked, err := t.store.Lock(ctx, key, now, now.Add(lockout))
+	if err != nil {
+		return 0, err
+	}
+	if !locked {
+		// Concurrent attempt has locked key first
+		return lockout, nil
+	}
+	if counter.Lockouts > 0 {
+		t.log.Info(parent, fmt.Sprintf("Lockout of %s has ended, attempt is checked, key is locked for %v if it fails", key, lockout))
+		return 0, nil
+	}
+	t.log.Warning(parent, fmt.Sprintf("Lockout %s for %v after %d failed attempts", key, lockout, failures-1))
+	return lockout, nil
+}
+
+// lockout returns lockout time doubled for every previous lockout
+func (t *Throttler) lockout(lockouts int) time.Duration {
+	lockout := t.policy.Lockout
+	for i := 0; i < lockouts && lockout < t.policy.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > t.policy.MaxLockout {
+		lockout = t.policy.MaxLockout
+	}
+	return lockout
+}
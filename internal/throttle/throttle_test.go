@@ -0,0 +1,140 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aprokhorov-diploma-1/internal/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottler_Lockout(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+	ctx := context.Background()
+	now := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	th := New(NewMemStore(), Policy{
+		LoginFailures: 3,
+		IPFailures:    10,
+		Lockout:       30 * time.Second,
+		MaxLockout:    2 * time.Minute,
+		Window:        time.Hour,
+	}, log)
+	th.now = func() time.Time { return now }
+
+	attempt := func(login string, ip string) time.Duration {
+		retry, err := th.Attempt(ctx, login, ip)
+		require.NoError(t, err)
+		return retry
+	}
+
+	// Allowed attempts
+	for i := 0; i < 3; i++ {
+		assert.Zero(t, attempt("User1", "10.0.0.1"))
+	}
+
+	// Attempt over allowed ones is locked out, attempts during lockout are not counted,
+	// login case doesn't matter
+	assert.Equal(t, 30*time.Second, attempt("User1", "10.0.0.2"))
+	assert.Equal(t, 30*time.Second, attempt("user1", "10.0.0.1"))
+
+	// First attempt after lockout is checked, wrong password keeps login locked for twice longer
+	for _, want := range []time.Duration{30 * time.Second, time.Minute} {
+		now = now.Add(want)
+		assert.Zero(t, attempt("User1", "10.0.0.2"))
+		assert.Equal(t, 2*want, attempt("User1", "10.0.0.2"))
+	}
+	now = now.Add(2 * time.Minute)
+	assert.Zero(t, attempt("User1", "10.0.0.2"))
+	assert.Equal(t, 2*time.Minute, attempt("User1", "10.0.0.2"), "lockout is limited by max")
+
+	// Right password after lockout resets login counter
+	now = now.Add(2 * time.Minute)
+	assert.Zero(t, attempt("User1", "10.0.0.2"))
+	require.NoError(t, th.Success(ctx, "User1", "10.0.0.2"))
+	for i := 0; i < 3; i++ {
+		assert.Zero(t, attempt("User1", "10.0.0.2"))
+	}
+	assert.Equal(t, 30*time.Second, attempt("User1", "10.0.0.2"))
+
+	// Other login from the same IP is not locked yet
+	assert.Zero(t, attempt("User2", "10.0.0.1"))
+
+	// Success doesn't reset IP counter, only successful attempt itself is taken back
+	require.NoError(t, th.Success(ctx, "User2", "10.0.0.1"))
+	for i := 0; i < 7; i++ {
+		assert.Zero(t, attempt(fmt.Sprintf("Guess%d", i), "10.0.0.1"))
+	}
+	assert.Equal(t, 30*time.Second, attempt("User2", "10.0.0.1"), "IP has reached its limit")
+
+	// Failures are forgotten after window
+	now = now.Add(2 * time.Hour)
+	require.NoError(t, th.HouseKeeper(ctx))
+	assert.Zero(t, attempt("User3", "10.0.0.1"))
+}
+
+func TestThrottler_ConcurrentAttempts(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+	ctx := context.Background()
+
+	th := New(NewMemStore(), DefaultPolicy(), log)
+
+	var (
+		wg      sync.WaitGroup
+		allowed int32
+	)
+	for i := 0; i < 60; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			retry, err := th.Attempt(ctx, "User1", fmt.Sprintf("10.0.0.%d", i))
+			assert.NoError(t, err)
+			if retry == 0 {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(DefaultPolicy().LoginFailures), atomic.LoadInt32(&allowed))
+}
+
+func TestThrottler_ConcurrentAttemptsAfterLockout(t *testing.T) {
+	log, _ := logger.NewZeroLogger("error")
+	ctx := context.Background()
+	now := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	th := New(NewMemStore(), DefaultPolicy(), log)
+	th.now = func() time.Time { return now }
+	for i := 0; i <= DefaultPolicy().LoginFailures; i++ {
+		_, err := th.Attempt(ctx, "User1", "10.0.0.1")
+		require.NoError(t, err)
+	}
+	now = now.Add(DefaultPolicy().Lockout)
+
+	// Only one attempt is checked after lockout
+	var (
+		wg      sync.WaitGroup
+		allowed int32
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			retry, err := th.Attempt(ctx, "User1", fmt.Sprintf("10.0.1.%d", i))
+			assert.NoError(t, err)
+			if retry == 0 {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&allowed))
+}
@@ -0,0 +1,142 @@
+package verificator
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//go:embed common-passwords.txt
+var commonPasswords string
+
+var loginFormat = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Violation is one broken rule of credentials policy
+type Violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// CredentialsPolicy sets rules for login and password on registration
+type CredentialsPolicy struct {
+	LoginMinLength    int
+	LoginMaxLength    int
+	PasswordMinLength int
+	PasswordMaxLength int // bcrypt uses only first 72 bytes
+	PasswordClasses   int // lower, upper, digits and others
+	DenyList          map[string]struct{}
+}
+
+func DefaultCredentialsPolicy() CredentialsPolicy {
+	p := CredentialsPolicy{
+		LoginMinLength:    3,
+		LoginMaxLength:    64,
+		PasswordMinLength: 8,
+		PasswordMaxLength: 72,
+		PasswordClasses:   2,
+		DenyList:          make(map[string]struct{}),
+	}
+	// Embedded list is valid, error is impossible
+	_ = p.AddDenyList(strings.NewReader(commonPasswords))
+	return p
+}
+
+// AddDenyList adds passwords from reader, one per line, to deny-list
+func (p CredentialsPolicy) AddDenyList(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if password := strings.TrimSpace(scanner.Text()); password != "" {
+			p.DenyList[strings.ToLower(password)] = struct{}{}
+		}
+	}
+	return scanner.Err()
+}
+
+// Validate returns every rule broken by login and password, nil if there are none
+func (p CredentialsPolicy) Validate(login string, password string) []Violation {
+	return append(p.ValidateLogin(login), p.ValidatePassword(login, password)...)
+}
+
+func (p CredentialsPolicy) ValidateLogin(login string) []Violation {
+	var violations []Violation
+	length := utf8.RuneCountInString(login)
+	if length < p.LoginMinLength || length > p.LoginMaxLength {
+		violations = append(violations, Violation{
+			Field:   "login",
+			Rule:    "length",
+			Message: fmt.Sprintf("login must be from %d to %d characters long", p.LoginMinLength, p.LoginMaxLength),
+		})
+	}
+	if login != "" && !loginFormat.MatchString(login) {
+		violations = append(violations, Violation{
+			Field:   "login",
+			Rule:    "format",
+			Message: "login may contain only latin letters, digits, '.', '_' and '-'",
+		})
+	}
+	return violations
+}
+
+func (p CredentialsPolicy) ValidatePassword(login string, password string) []Violation {
+	var violations []Violation
+	length := utf8.RuneCountInString(password)
+	if length < p.PasswordMinLength {
+		violations = append(violations, Violation{
+			Field:   "password",
+			Rule:    "min_length",
+			Message: fmt.Sprintf("password must be at least %d characters long", p.PasswordMinLength),
+		})
+	}
+	if len(password) > p.PasswordMaxLength {
+		violations = append(violations, Violation{
+			Field:   "password",
+			Rule:    "max_length",
+			Message: fmt.Sprintf("password must be at most %d bytes long", p.PasswordMaxLength),
+		})
+	}
+	if classes := charClasses(password); classes < p.PasswordClasses {
+		violations = append(violations, Violation{
+			Field:   "password",
+			Rule:    "char_classes",
+			Message: fmt.Sprintf("password must contain at least %d of: lowercase, uppercase, digits, other characters", p.PasswordClasses),
+		})
+	}
+	if _, denied := p.DenyList[strings.ToLower(password)]; denied {
+		violations = append(violations, Violation{
+			Field:   "password",
+			Rule:    "common",
+			Message: "password is too common",
+		})
+	}
+	if password != "" && strings.EqualFold(password, login) {
+		violations = append(violations, Violation{
+			Field:   "password",
+			Rule:    "same_as_login",
+			Message: "password must differ from login",
+		})
+	}
+	return violations
+}
+
+func charClasses(s string) int {
+	var lower, upper, digit, other int
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
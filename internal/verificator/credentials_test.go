@@ -0,0 +1,47 @@
+package verificator
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentialsPolicy_Validate(t *testing.T) {
+	policy := DefaultCredentialsPolicy()
+
+	tests := []struct {
+		name      string
+		login     string
+		password  string
+		wantRules []string
+	}{
+		{name: "Valid credentials", login: "gopher.user", password: "Tr0ub4dor&3"},
+		{name: "Empty credentials", login: "", password: "", wantRules: []string{"length", "min_length", "char_classes"}},
+		{name: "Whitespace login", login: " gopher ", password: "Tr0ub4dor&3", wantRules: []string{"format"}},
+		{name: "Too long login", login: strings.Repeat("a", 65), password: "Tr0ub4dor&3", wantRules: []string{"length"}},
+		{name: "Short password", login: "gopher", password: "Ab1", wantRules: []string{"min_length"}},
+		{name: "Too long password", login: "gopher", password: strings.Repeat("a1", 40), wantRules: []string{"max_length"}},
+		{name: "Single character class", login: "gopher", password: "abcdefghij", wantRules: []string{"char_classes"}},
+		{name: "Common password", login: "gopher", password: "Password1", wantRules: []string{"common"}},
+		{name: "Password same as login", login: "Gopher2022", password: "gopher2022", wantRules: []string{"same_as_login"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rules []string
+			for _, v := range policy.Validate(tt.login, tt.password) {
+				rules = append(rules, v.Rule)
+			}
+			assert.Equal(t, tt.wantRules, rules)
+		})
+	}
+}
+
+func TestCredentialsPolicy_AddDenyList(t *testing.T) {
+	policy := DefaultCredentialsPolicy()
+	assert.Empty(t, policy.ValidatePassword("gopher", "Gophermart2022"))
+
+	err := policy.AddDenyList(strings.NewReader("gophermart2022\n\n"))
+	assert.NoError(t, err)
+	assert.Len(t, policy.ValidatePassword("gopher", "Gophermart2022"), 1)
+}